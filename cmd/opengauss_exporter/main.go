@@ -26,6 +26,9 @@ var (
 	ogExporter   *exporter.Exporter
 	ReloadLock   sync.Mutex
 	args         = &Args{}
+
+	serveCmd       *kingpin.CmdClause
+	configCheckCmd *kingpin.CmdClause
 )
 
 // General generic options
@@ -47,6 +50,15 @@ type Args struct {
 	ExplainOnly            *bool   `long:"explain" description:"explain server planned queries"`
 	DisableSettingsMetrics *bool
 	TimeToString           *bool
+	CheckConfigPath        *string
+	ConfigVars             *string
+	ConfigWatchInterval    *time.Duration
+	BackgroundCollect      *bool
+	ScrapeConcurrency      *int
+	MaxOpenConns           *int
+	MaxIdleConns           *int
+	ConnMaxLifetime        *time.Duration
+	ScrapeBudget           *time.Duration
 }
 
 // RetrieveTargetURL  priority: cli-args > env  > env file path
@@ -102,14 +114,46 @@ func initArgs(args *Args) {
 		Default("").
 		Envar("OG_EXPORTER_CONFIG").
 		String()
+	args.ConfigVars = kingpin.Flag("config-vars", "A list of key=value separated by comma(,), used as template variables of config files. Config files are executed as templates only if set.").
+		Default("").
+		Envar("OG_EXPORTER_CONFIG_VARS").
+		String()
+	args.ConfigWatchInterval = kingpin.Flag("config-watch-interval", "Reload config when files under config path changed, checked every interval. 0 disables it.").
+		Default("0s").
+		Envar("OG_EXPORTER_CONFIG_WATCH_INTERVAL").
+		Duration()
 	args.ConstLabels = kingpin.Flag("constantLabels", "A list of label=value separated by comma(,).").
 		Default("").
 		Envar("OG_EXPORTER_CONSTANT_LABELS").
 		String()
-	// args.ServerTags = kingpin.Flag("tags", "tags,comma separated list of server tag").
-	// 	Default("").
-	// 	Envar("OG_EXPORTER_TAG").
-	// 	String()
+	args.ServerTags = kingpin.Flag("tags", "tags,comma separated list of server tag, including profile minimal, standard or full").
+		Default("").
+		Envar("OG_EXPORTER_TAG").
+		String()
+	args.BackgroundCollect = kingpin.Flag("background-collect", "Run queries in background on their own interval, scrapes serve the latest results.").
+		Default("false").
+		Envar("OG_EXPORTER_BACKGROUND_COLLECT").
+		Bool()
+	args.ScrapeConcurrency = kingpin.Flag("scrape-concurrency", "Max number of targets scraped at the same time.").
+		Default("4").
+		Envar("OG_EXPORTER_SCRAPE_CONCURRENCY").
+		Int()
+	args.MaxOpenConns = kingpin.Flag("max-open-conns", "Max open connections per target, also the number of queries running at the same time.").
+		Default("1").
+		Envar("OG_EXPORTER_MAX_OPEN_CONNS").
+		Int()
+	args.MaxIdleConns = kingpin.Flag("max-idle-conns", "Max idle connections per target.").
+		Default("1").
+		Envar("OG_EXPORTER_MAX_IDLE_CONNS").
+		Int()
+	args.ConnMaxLifetime = kingpin.Flag("conn-max-lifetime", "Max lifetime of a connection, e.g. 1h. 0 means forever.").
+		Default("0s").
+		Envar("OG_EXPORTER_CONN_MAX_LIFETIME").
+		Duration()
+	args.ScrapeBudget = kingpin.Flag("scrape-budget", "Max execution time of queries per target and scrape, e.g. 10s. 0 means unlimited.").
+		Default("0s").
+		Envar("OG_EXPORTER_SCRAPE_BUDGET").
+		Duration()
 	args.DisableCache = kingpin.Flag("disable-cache", "force not using cache").
 		Default("false").
 		Envar("OG_EXPORTER_DISABLE_CACHE").
@@ -155,51 +199,65 @@ func initArgs(args *Args) {
 	args.ExplainOnly = kingpin.Flag("explain", "explain server planned queries").
 		Bool()
 
+	serveCmd = kingpin.Command("serve", "run exporter, the default command").Default()
+	configCheckCmd = kingpin.Command("config", "config file utilities").
+		Command("check", "validate config files, report all problems and exit non-zero if any")
+	args.CheckConfigPath = configCheckCmd.Arg("path", "path to config dir or file").Required().String()
+
 	log.AddFlags(kingpin.CommandLine)
 }
 
+// checkConfig lint config files and returns exit code
+func checkConfig(configPath, configVars string) int {
+	lintErrors := exporter.LintConfig(configPath, exporter.ParseConfigVars(configVars))
+	for _, err := range lintErrors {
+		fmt.Fprintln(os.Stderr, err.Error())
+	}
+	if len(lintErrors) > 0 {
+		fmt.Fprintf(os.Stderr, "%d problems found in %s\n", len(lintErrors), configPath)
+		return 1
+	}
+	fmt.Printf("config %s is valid\n", configPath)
+	return 0
+}
+
 func newOgExporter(args *Args) (*exporter.Exporter, error) {
 	dsn := args.RetrieveTargetURL()
 	ex, err := exporter.NewExporter(
 		exporter.WithDNS(dsn),
 		exporter.WithConfig(*args.ConfigPath),
+		exporter.WithConfigVars(*args.ConfigVars),
+		exporter.WithConfigWatch(*args.ConfigWatchInterval),
 		exporter.WithConstLabels(*args.ConstLabels),
 		exporter.WithCacheDisabled(*args.DisableCache),
+		exporter.WithBackgroundCollect(*args.BackgroundCollect),
+		exporter.WithScrapeConcurrency(*args.ScrapeConcurrency),
+		exporter.WithPool(*args.MaxOpenConns, *args.MaxIdleConns, *args.ConnMaxLifetime),
+		exporter.WithScrapeBudget(*args.ScrapeBudget),
 		// exporter.WithFailFast(*args.FailFast),
 		exporter.WithNamespace(*args.ExporterNamespace),
 		exporter.WithAutoDiscovery(*args.AutoDiscovery),
 		exporter.WithExcludeDatabases(*args.ExcludeDatabase),
 		exporter.WithDisableSettingsMetrics(*args.DisableSettingsMetrics),
 		exporter.WithTimeToString(*args.TimeToString),
-		// exporter.WithTags(*args.ServerTags),
+		exporter.WithTags(*args.ServerTags),
 	)
 	return ex, err
 
 }
 
+// Reload reloads config files of the running exporter, the previous config is kept if any file is invalid
 func Reload() error {
 	ReloadLock.Lock()
 	defer ReloadLock.Unlock()
-	log.Debugf("reload request received, launch new exporter instance")
-
-	// create a new exporter
-	newExporter, err := newOgExporter(args)
-	// if launch new exporter failed, do nothing
-	if err != nil {
+	log.Debugf("reload request received, reload config of exporter")
+	if ogExporter == nil {
+		return fmt.Errorf("exporter is not running")
+	}
+	if err := ogExporter.ReloadConfig(); err != nil {
 		log.Errorf("fail to reload exporter: %s", err.Error())
 		return err
 	}
-
-	log.Debugf("shutdown old exporter instance")
-	// if older one exists, close and unregister it
-	// if ogExporter != nil {
-	// 	// DO NOT MANUALLY CLOSE OLD EXPORTER INSTANCE because the stupid implementation of sql.DB
-	// 	// there connection will be automatically released after 1 min
-	// 	prometheus.Unregister(ogExporter)
-	//
-	// }
-	// prometheus.MustRegister(newExporter)
-	ogExporter = newExporter
 	log.Infof("server reloaded")
 	return nil
 }
@@ -208,7 +266,9 @@ func runApp(args *Args) {
 	// 命令行参数
 	initArgs(args)
 
-	kingpin.Parse()
+	if kingpin.Parse() == configCheckCmd.FullCommand() {
+		os.Exit(checkConfig(*args.CheckConfigPath, *args.ConfigVars))
+	}
 
 	var err error
 	ogExporter, err = newOgExporter(args)
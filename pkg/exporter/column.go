@@ -3,33 +3,193 @@
 package exporter
 
 import (
-	"github.com/prometheus/client_golang/prometheus"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
 )
 
+// NULL and unparsable value policies
 const (
-	DISCARD      = "DISCARD" // Ignore this column (when SELECT *)
-	LABEL        = "LABEL"   // Use this column as a label
-	COUNTER      = "COUNTER" // Use this column as a counter
-	GAUGE        = "GAUGE"   // Use this column as a gauge
-	HISTOGRAM    = "HISTOGRAM"
-	MappedMETRIC = "MAPPEDMETRIC"
-	DURATION     = "DURATION"
+	onNullNaN   = "nan"
+	onNullSkip  = "skip"
+	onErrorSkip = "skip"
+	onErrorZero = "zero"
+	onErrorFail = "fail"
+)
+
+const (
+	DISCARD      = "DISCARD"      // Ignore this column (when SELECT *)
+	LABEL        = "LABEL"        // Use this column as a label
+	COUNTER      = "COUNTER"      // Use this column as a counter
+	GAUGE        = "GAUGE"        // Use this column as a gauge
+	HISTOGRAM    = "HISTOGRAM"    // Use this column as a histogram (with _bucket, _sum and _count columns)
+	MappedMETRIC = "MAPPEDMETRIC" // Map the text value of this column to a gauge through mapping
+	DURATION     = "DURATION"     // Use this column as a gauge of elapsed time, in ms unless unit is given
+	DELTA        = "DELTA"        // Use the increase of this counter column since last scrape as a gauge
+	RATE         = "RATE"         // Use the per-second rate of this counter column since last scrape as a gauge
+	LSN          = "LSN"          // Use this column as a gauge of WAL location like 0/3000060, converted to byte offset
+	AGE          = "AGE"          // Use seconds elapsed since the timestamp of this column (database clock) as a gauge
+	INTERVAL     = "INTERVAL"     // Use this column as a gauge of interval text like 1 day 02:03:04, converted to seconds
+	STATESET     = "STATESET"     // Use this column as a stateset, one series per declared state, 1 for current state
 )
 
 var ColumnUsage = map[string]bool{
-	DISCARD: true,
-	LABEL:   true,
-	COUNTER: true,
-	GAUGE:   true,
+	DISCARD:      true,
+	LABEL:        true,
+	COUNTER:      true,
+	GAUGE:        true,
+	HISTOGRAM:    true,
+	MappedMETRIC: true,
+	DURATION:     true,
+	DELTA:        true,
+	RATE:         true,
+	LSN:          true,
+	AGE:          true,
+	INTERVAL:     true,
+	STATESET:     true,
 }
 
 type Column struct {
-	Name           string               `yaml:"name"`
-	Desc           string               `yaml:"description,omitempty"`
-	Usage          string               `yaml:"usage,omitempty"`
-	Rename         string               `yaml:"rename,omitempty"`
-	DisCard        bool                 `yaml:"-"`
-	Histogram      bool                 `yaml:"-"` // Should metric be treated as a histogram?
-	PrometheusDesc *prometheus.Desc     `yaml:"-"`
-	PrometheusType prometheus.ValueType `yaml:"-"`
+	Name           string             `yaml:"name"`
+	Desc           string             `yaml:"description,omitempty"`
+	Usage          string             `yaml:"usage,omitempty"`
+	Rename         string             `yaml:"rename,omitempty"`          // published metric or label name instead of column name
+	Mapping        map[string]float64 `yaml:"mapping,omitempty"`         // MAPPEDMETRIC: text value -> metric value
+	MappingDefault *float64           `yaml:"mapping_default,omitempty"` // MAPPEDMETRIC: value for unmapped text, skip series if not set
+	Unit           string             `yaml:"unit,omitempty"`            // unit of column value (us, ms, s, min, B, kB, 8kB ...), converted to seconds or bytes
+	Raw            bool               `yaml:"raw,omitempty"`             // DELTA/RATE: also emit the raw value as a counter
+	OnNull         string             `yaml:"on_null,omitempty"`         // NULL value policy: nan (default), skip, or a default number
+	OnError        string             `yaml:"on_error,omitempty"`        // unparsable value policy: skip (default), zero, or fail the query
+	LagFrom        string             `yaml:"lag_from,omitempty"`        // LSN: emit bytes behind the LSN of this column instead of the position
+	States         []string           `yaml:"states,omitempty"`          // STATESET: possible values of the column
+	nullValue      *float64           `yaml:"-"`                         // parsed on_null default number
+	DisCard        bool               `yaml:"-"`
+	Histogram      bool               `yaml:"-"` // Should metric be treated as a histogram?
+}
+
+// MappedValue translate a MAPPEDMETRIC column value through the mapping table.
+// Exact matches win over case-insensitive ones, unmapped values fall back to
+// MappingDefault if given.
+func (c *Column) MappedValue(v string) (float64, bool) {
+	if f, ok := c.Mapping[v]; ok {
+		return f, true
+	}
+	for k, f := range c.Mapping {
+		if strings.EqualFold(k, v) {
+			return f, true
+		}
+	}
+	if c.MappingDefault != nil {
+		return *c.MappingDefault, true
+	}
+	return 0, false
+}
+
+// checkPolicy validate on_null and on_error settings
+func (c *Column) checkPolicy() error {
+	c.nullValue = nil
+	switch c.OnNull = strings.ToLower(c.OnNull); c.OnNull {
+	case "", onNullNaN, onNullSkip:
+	default:
+		v, err := strconv.ParseFloat(c.OnNull, 64)
+		if err != nil {
+			return fmt.Errorf("column %s have unsupported on_null: %s", c.Name, c.OnNull)
+		}
+		c.nullValue = &v
+	}
+	switch c.OnError = strings.ToLower(c.OnError); c.OnError {
+	case "", onErrorSkip, onErrorZero, onErrorFail:
+	default:
+		return fmt.Errorf("column %s have unsupported on_error: %s", c.Name, c.OnError)
+	}
+	return nil
+}
+
+// Value convert a column value to float64, applying on_null and on_error
+// policies. ok is false if no series should be emitted. err is returned
+// for unparsable values unless on_error is zero.
+func (c *Column) Value(v interface{}) (value float64, ok bool, err error) {
+	if v == nil {
+		switch {
+		case c.nullValue != nil:
+			return *c.nullValue, true, nil
+		case c.OnNull == onNullSkip:
+			return math.NaN(), false, nil
+		default:
+			return math.NaN(), true, nil
+		}
+	}
+	value, ok = c.parse(v)
+	if ok {
+		return value, true, nil
+	}
+	if c.OnError == onErrorZero {
+		return 0, true, nil
+	}
+	return math.NaN(), false, &ErrorParseValue{fmt.Sprintf("unparsable value %v", v)}
+}
+
+// StateValues returns 1 for the declared state matching v and 0 for others,
+// in the order of States. Matching is case-insensitive.
+func (c *Column) StateValues(v string) []float64 {
+	values := make([]float64, len(c.States))
+	for i, state := range c.States {
+		if strings.EqualFold(state, v) {
+			values[i] = 1
+		}
+	}
+	return values
+}
+
+// parse convert a non-null column value to float64 according to column usage
+func (c *Column) parse(v interface{}) (float64, bool) {
+	switch c.Usage {
+	case LSN:
+		return dbToLSN(v)
+	case AGE:
+		return dbToTimestamp(v)
+	case INTERVAL:
+		return dbToInterval(v)
+	default:
+		return dbToFloat64(v)
+	}
+}
+
+// PublishName returns the name used in metric or label names, which is
+// Rename if given and the column name otherwise.
+func (c *Column) PublishName() string {
+	if c.Rename != "" {
+		return c.Rename
+	}
+	return c.Name
 }
+
+// metricSuffix returns the base unit suffix appended to the metric name, if
+// the column name does not carry it already.
+func (c *Column) metricSuffix() string {
+	var suffix string
+	switch {
+	case c.Usage == AGE:
+		suffix = "_age_seconds"
+	case c.Usage == INTERVAL:
+		suffix = "_seconds"
+	case c.Unit != "":
+		suffix = "_" + unitConversions[c.Unit].base
+	default:
+		return ""
+	}
+	if strings.HasSuffix(c.PublishName(), suffix) {
+		return ""
+	}
+	return suffix
+}
+
+// Histogram auxiliary column suffixes. A HISTOGRAM column holds the array of
+// bucket upper bounds, and the suffixed columns hold the cumulative bucket
+// counts array, the sum and the count of observations.
+const (
+	histogramBucketSuffix = "_bucket"
+	histogramSumSuffix    = "_sum"
+	histogramCountSuffix  = "_count"
+)
@@ -0,0 +1,50 @@
+// Copyright © 2020 Bin Liu <bin.liu@enmotech.com>
+
+package exporter
+
+import (
+	"github.com/stretchr/testify/assert"
+	"math"
+	"testing"
+)
+
+func TestColumn_Value(t *testing.T) {
+	tests := []struct {
+		name    string
+		col     *Column
+		v       interface{}
+		want    float64
+		wantOk  bool
+		wantErr bool
+	}{
+		{name: "value", col: &Column{}, v: int64(3), want: 3, wantOk: true},
+		{name: "null_nan", col: &Column{}, v: nil, want: math.NaN(), wantOk: true},
+		{name: "null_skip", col: &Column{OnNull: "skip"}, v: nil, wantOk: false},
+		{name: "null_default", col: &Column{OnNull: "0"}, v: nil, want: 0, wantOk: true},
+		{name: "error_skip", col: &Column{}, v: "0/3000060", wantOk: false, wantErr: true},
+		{name: "error_zero", col: &Column{OnError: "Zero"}, v: "0/3000060", want: 0, wantOk: true},
+		{name: "error_fail", col: &Column{OnError: "fail"}, v: "0/3000060", wantOk: false, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.NoError(t, tt.col.checkPolicy())
+			got, ok, err := tt.col.Value(tt.v)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Value() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			assert.Equal(t, tt.wantOk, ok)
+			if ok && math.IsNaN(tt.want) {
+				assert.True(t, math.IsNaN(got))
+			} else if ok {
+				assert.Equal(t, tt.want, got)
+			}
+		})
+	}
+}
+
+func TestColumn_checkPolicy(t *testing.T) {
+	assert.Error(t, (&Column{OnNull: "zero"}).checkPolicy())
+	assert.Error(t, (&Column{OnError: "nan"}).checkPolicy())
+	assert.NoError(t, (&Column{OnNull: "-1", OnError: "skip"}).checkPolicy())
+}
@@ -3,16 +3,36 @@
 package exporter
 
 import (
+	"bytes"
 	"fmt"
 	"github.com/prometheus/common/log"
 	"gopkg.in/yaml.v2"
 	"io/ioutil"
 	"os"
 	"path"
+	"path/filepath"
+	"regexp"
 	"strings"
+	"text/template"
 )
 
+// envVarRegexp matches ${VAR} and ${VAR:-default}
+var envVarRegexp = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)(?::-([^}]*))?\}`)
+
+// LoadConfig load queries from config file or dir
 func LoadConfig(configPath string) (queries map[string]*QueryInstance, err error) {
+	return LoadConfigWithVars(configPath, nil)
+}
+
+// LoadConfigWithVars load queries from config file or dir, config content is rendered with
+// environment variables and given template variables, see renderConfig
+func LoadConfigWithVars(configPath string, vars map[string]string) (queries map[string]*QueryInstance, err error) {
+	return loadConfig(configPath, vars, false)
+}
+
+// loadConfig load queries from config file or dir, in strict mode an invalid file in dir fails
+// the whole config instead of being skipped
+func loadConfig(configPath string, vars map[string]string, strict bool) (queries map[string]*QueryInstance, err error) {
 	stat, err := os.Stat(configPath)
 	if err != nil {
 		return nil, fmt.Errorf("invalid config path: %s: %w", configPath, err)
@@ -37,7 +57,10 @@ func LoadConfig(configPath string) (queries map[string]*QueryInstance, err error
 		queries = make(map[string]*QueryInstance)
 		var queryCount, configCount int
 		for _, confPath := range confFiles {
-			if singleQueries, err := LoadConfig(confPath); err != nil {
+			if singleQueries, err := loadConfig(confPath, vars, strict); err != nil {
+				if strict {
+					return nil, err
+				}
 				log.Warnf("skip config %s due to error: %s", confPath, err.Error())
 			} else {
 				configCount++
@@ -59,10 +82,18 @@ func LoadConfig(configPath string) (queries map[string]*QueryInstance, err error
 	if err != nil {
 		return nil, fmt.Errorf("fail reading config file %s: %w", configPath, err)
 	}
+	if content, err = renderConfig(content, configPath, vars); err != nil {
+		return nil, err
+	}
 	queries, err = ParseConfig(content, stat.Name())
 	if err != nil {
 		return nil, err
 	}
+	for _, query := range queries {
+		if err := query.loadSQLFiles(filepath.Dir(configPath), vars); err != nil {
+			return nil, err
+		}
+	}
 	log.Debugf("load %d queries from %s, ", len(queries), configPath)
 	return queries, nil
 
@@ -88,3 +119,76 @@ func ParseConfig(content []byte, path string) (queries map[string]*QueryInstance
 	}
 	return
 }
+
+// ParseConfigVars parse template variables of config files from a list of key=value separated by comma
+func ParseConfigVars(s string) map[string]string {
+	return parseConstLabels(s)
+}
+
+// renderConfig expands ${VAR} and ${VAR:-default} with environment variables, then executes
+// content as go template with vars, e.g. {{ .min_size }}. Unset or empty VAR is replaced by default,
+// it is an error if VAR has no default. Environment variables are expanded in raw content, so values
+// must not contain YAML syntax such as ": " or newlines. Templates are only executed when vars are
+// given, so that configs with "{{" in SQL or JSON keep loading as they are.
+func renderConfig(content []byte, name string, vars map[string]string) ([]byte, error) {
+	var unset []string
+	content = envVarRegexp.ReplaceAllFunc(content, func(m []byte) []byte {
+		sub := envVarRegexp.FindSubmatchIndex(m)
+		if value := os.Getenv(string(m[sub[2]:sub[3]])); value != "" {
+			return []byte(value)
+		}
+		if sub[4] < 0 {
+			unset = append(unset, string(m[sub[2]:sub[3]]))
+			return nil
+		}
+		return m[sub[4]:sub[5]]
+	})
+	if len(unset) > 0 {
+		return nil, fmt.Errorf("environment variable %s is not set and has no default", strings.Join(unset, ", "))
+	}
+	if len(vars) == 0 || !bytes.Contains(content, []byte("{{")) {
+		return content, nil
+	}
+	tmpl, err := template.New(name).Option("missingkey=error").Parse(string(content))
+	if err != nil {
+		return nil, fmt.Errorf("malformed config template: %w", err)
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, vars); err != nil {
+		return nil, fmt.Errorf("fail rendering config template: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// loadSQLFiles replaces sql_file of queries with rendered content of that file
+func (q *QueryInstance) loadSQLFiles(dir string, vars map[string]string) error {
+	for _, query := range q.Queries {
+		if query.SQLFile == "" {
+			continue
+		}
+		if query.SQL != "" {
+			return fmt.Errorf("query %s have both sql and sql_file", q.Name)
+		}
+		sqlPath := sqlFilePath(dir, query.SQLFile)
+		content, err := ioutil.ReadFile(sqlPath)
+		if err != nil {
+			return fmt.Errorf("query %s: fail reading sql file: %w", q.Name, err)
+		}
+		if content, err = renderConfig(content, sqlPath, vars); err != nil {
+			return fmt.Errorf("query %s: %w", q.Name, err)
+		}
+		query.SQL, query.SQLFile = strings.TrimSpace(string(content)), ""
+		if err := query.checkParams(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sqlFilePath returns path of sql_file, relative to dir of config file
+func sqlFilePath(dir, sqlFile string) string {
+	if filepath.IsAbs(sqlFile) {
+		return sqlFile
+	}
+	return filepath.Join(dir, sqlFile)
+}
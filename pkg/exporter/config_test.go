@@ -4,6 +4,11 @@ package exporter
 
 import (
 	"fmt"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
 	"testing"
 )
 
@@ -150,3 +155,61 @@ func TestParseConfig(t *testing.T) {
 		})
 	}
 }
+
+func Test_renderConfig(t *testing.T) {
+	_ = os.Setenv("OG_TEST_LIMIT", "20")
+	defer os.Unsetenv("OG_TEST_LIMIT")
+	got, err := renderConfig([]byte("limit ${OG_TEST_LIMIT:-10} size ${OG_TEST_SIZE:-1024} ${OG_TEST_NONE:-} {{ .schema }}"), "test", map[string]string{"schema": "public"})
+	assert.NoError(t, err)
+	assert.Equal(t, "limit 20 size 1024  public", string(got))
+
+	_, err = renderConfig([]byte("limit ${OG_TEST_LIMIT} size ${OG_TEST_NONE}"), "test", nil)
+	assert.EqualError(t, err, "environment variable OG_TEST_NONE is not set and has no default")
+
+	vars := map[string]string{"schema": "public"}
+	_, err = renderConfig([]byte("{{ .missing }}"), "test", vars)
+	assert.Error(t, err)
+	_, err = renderConfig([]byte("{{ .missing "), "test", vars)
+	assert.Error(t, err)
+
+	// without vars content is not a template, e.g. array literals and JSON in SQL
+	got, err = renderConfig([]byte(`select '{{1,2},{3,4}}'::int[][], '{"a": {"b": 1}}'::json`), "test", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, `select '{{1,2},{3,4}}'::int[][], '{"a": {"b": 1}}'::json`, string(got))
+}
+
+func TestLoadConfigWithVars(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer os.RemoveAll(dir)
+	config := `og_tables_size:
+  query:
+    - sql_file: tables_size.sql
+  metrics:
+    - name: tablename
+      usage: LABEL
+    - name: size
+      usage: GAUGE
+`
+	assert.NoError(t, ioutil.WriteFile(path.Join(dir, "tables.yaml"), []byte(config), 0644))
+	assert.NoError(t, ioutil.WriteFile(path.Join(dir, "tables_size.sql"),
+		[]byte("select relname tablename, pg_table_size(relid) size from pg_stat_user_tables where schemaname = '{{ .schema }}'\n"), 0644))
+
+	queries, err := LoadConfigWithVars(dir, map[string]string{"schema": "public"})
+	assert.NoError(t, err)
+	if assert.Contains(t, queries, "og_tables_size") {
+		query := queries["og_tables_size"].Queries[0]
+		assert.Equal(t, "select relname tablename, pg_table_size(relid) size from pg_stat_user_tables where schemaname = 'public'", query.SQL)
+		assert.Equal(t, "", query.SQLFile)
+	}
+
+	_, err = LoadConfigWithVars(path.Join(dir, "tables.yaml"), map[string]string{"database": "postgres"})
+	assert.Error(t, err)
+
+	assert.NoError(t, ioutil.WriteFile(path.Join(dir, "tables.yaml"), []byte(strings.Replace(config, "sql_file: tables_size.sql", "sql_file: not_exists.sql", 1)), 0644))
+	_, err = LoadConfigWithVars(path.Join(dir, "tables.yaml"), nil)
+	assert.Error(t, err)
+}
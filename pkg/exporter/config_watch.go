@@ -0,0 +1,160 @@
+// Copyright © 2021 Bin Liu <bin.liu@enmotech.com>
+
+package exporter
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/prometheus/common/log"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// configHashsum returns sha256 of files read by loading config, see configFiles
+func configHashsum(configPath string, vars map[string]string) (string, error) {
+	files, err := configFiles(configPath, vars)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	for _, file := range files {
+		_, _ = h.Write([]byte(file))
+		_, _ = h.Write([]byte{0})
+		content, err := ioutil.ReadFile(file)
+		if os.IsNotExist(err) { // a missing sql file changes the hashsum once created
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		_, _ = h.Write(content)
+		_, _ = h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// configFiles returns files read by loadConfig: yaml files of config path and its sub dirs in the
+// same order, each followed by sql files referenced by sql_file of its queries
+func configFiles(configPath string, vars map[string]string) ([]string, error) {
+	stat, err := os.Stat(configPath)
+	if err != nil {
+		return nil, err
+	}
+	if stat.IsDir() {
+		entries, err := ioutil.ReadDir(configPath) // sorted by file name
+		if err != nil {
+			return nil, err
+		}
+		var files []string
+		for _, entry := range entries {
+			if !strings.HasSuffix(entry.Name(), ".yaml") && !entry.IsDir() {
+				continue
+			}
+			subFiles, err := configFiles(path.Join(configPath, entry.Name()), vars)
+			if err != nil {
+				return nil, err
+			}
+			files = append(files, subFiles...)
+		}
+		return files, nil
+	}
+	content, err := ioutil.ReadFile(configPath)
+	if err != nil {
+		return nil, err
+	}
+	return append([]string{configPath}, configSQLFiles(content, configPath, vars)...), nil
+}
+
+// configSQLFiles returns sorted paths of sql_file referenced by a config file, an invalid
+// config file references none
+func configSQLFiles(content []byte, configPath string, vars map[string]string) []string {
+	content, err := renderConfig(content, configPath, vars)
+	if err != nil {
+		return nil
+	}
+	queries := make(map[string]*QueryInstance)
+	if err := yaml.Unmarshal(content, &queries); err != nil {
+		return nil
+	}
+	var files []string
+	for _, q := range queries {
+		if q == nil {
+			continue
+		}
+		for _, query := range q.Queries {
+			if query != nil && query.SQLFile != "" {
+				files = append(files, sqlFilePath(filepath.Dir(configPath), query.SQLFile))
+			}
+		}
+	}
+	sort.Strings(files)
+	return files
+}
+
+// setConfigStatus records result of loading config with given hashsum
+func (e *Exporter) setConfigStatus(hashsum string, err error) {
+	if e.configFileError == nil {
+		return
+	}
+	e.configFileError.Reset()
+	var value float64
+	if err != nil {
+		value = 1
+	}
+	e.configFileError.WithLabelValues(e.configPath, hashsum).Set(value)
+}
+
+// ReloadConfig loads config again and swaps it in only if every config file is valid
+func (e *Exporter) ReloadConfig() error {
+	// load and swap together, so that the exporter and its servers end up with the same config
+	e.reloadMtx.Lock()
+	defer e.reloadMtx.Unlock()
+	metricMap, _, err := e.loadConfig(true)
+	if err != nil {
+		log.Errorf("fail reloading config %s, keep using previous one: %s", e.configPath, err)
+		return err
+	}
+	e.metricMtx.Lock()
+	e.metricMap = metricMap
+	e.metricMtx.Unlock()
+	e.servers.setQueryInstanceMap(metricMap)
+	log.Infof("config %s reloaded, %d queries", e.configPath, len(metricMap))
+	return nil
+}
+
+// watchConfig polls config path every interval, and reloads config once files changed from
+// lastHashsum and stay unchanged for another interval
+func (e *Exporter) watchConfig(interval time.Duration, lastHashsum string) {
+	var pending string
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-e.done:
+			return
+		case <-ticker.C:
+		}
+		hashsum, err := configHashsum(e.configPath, e.configVars)
+		if err != nil {
+			log.Warnf("fail checking config %s: %s", e.configPath, err)
+			continue
+		}
+		if hashsum == lastHashsum {
+			pending = ""
+			continue
+		}
+		if hashsum != pending { // still changing, wait for next tick
+			pending = hashsum
+			continue
+		}
+		log.Infof("config %s changed, reloading", e.configPath)
+		lastHashsum, pending = hashsum, ""
+		_ = e.ReloadConfig()
+	}
+}
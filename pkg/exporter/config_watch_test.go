@@ -0,0 +1,179 @@
+// Copyright © 2021 Bin Liu <bin.liu@enmotech.com>
+
+package exporter
+
+import (
+	"fmt"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+	"testing"
+	"time"
+)
+
+const watchTestConfig = `og_tables_size:
+  query:
+    - sql: select relname tablename, pg_table_size(relid) size from pg_stat_user_tables
+  metrics:
+    - name: tablename
+      usage: LABEL
+    - name: size
+      usage: GAUGE
+`
+
+func configStatus(t *testing.T, e *Exporter) (float64, string) {
+	m, err := e.configFileError.GetMetricWithLabelValues(e.configPath, mustConfigHashsum(t, e.configPath))
+	if err != nil {
+		return -1, ""
+	}
+	pb := &dto.Metric{}
+	assert.NoError(t, m.Write(pb))
+	return pb.GetGauge().GetValue(), pb.GetLabel()[1].GetValue()
+}
+
+func mustConfigHashsum(t *testing.T, configPath string) string {
+	hashsum, err := configHashsum(configPath, nil)
+	assert.NoError(t, err)
+	return hashsum
+}
+
+func Test_configHashsum(t *testing.T) {
+	dir, err := ioutil.TempDir("", "watch")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer os.RemoveAll(dir)
+	empty := mustConfigHashsum(t, dir)
+	assert.NoError(t, ioutil.WriteFile(path.Join(dir, "a.yaml"), []byte(watchTestConfig), 0644))
+	one := mustConfigHashsum(t, dir)
+	assert.NotEqual(t, empty, one)
+	assert.NoError(t, ioutil.WriteFile(path.Join(dir, "README.md"), []byte("readme"), 0644))
+	assert.NoError(t, ioutil.WriteFile(path.Join(dir, "b.sql"), []byte("select 1"), 0644))
+	assert.Equal(t, one, mustConfigHashsum(t, dir))
+
+	// sub dirs are loaded as well
+	assert.NoError(t, os.Mkdir(path.Join(dir, "sub"), 0755))
+	assert.Equal(t, one, mustConfigHashsum(t, dir))
+	assert.NoError(t, ioutil.WriteFile(path.Join(dir, "sub", "c.yaml"), []byte(watchTestConfig), 0644))
+	two := mustConfigHashsum(t, dir)
+	assert.NotEqual(t, one, two)
+
+	// sql_file of a single config file, created later
+	configFile := path.Join(dir, "sub", "c.yaml")
+	assert.NoError(t, ioutil.WriteFile(configFile, []byte("og_a:\n  query:\n    - sql_file: ../c.sql\n"), 0644))
+	missing := mustConfigHashsum(t, configFile)
+	assert.NoError(t, ioutil.WriteFile(path.Join(dir, "c.sql"), []byte("select 1"), 0644))
+	created := mustConfigHashsum(t, configFile)
+	assert.NotEqual(t, missing, created)
+	assert.NoError(t, ioutil.WriteFile(path.Join(dir, "c.sql"), []byte("select 2"), 0644))
+	assert.NotEqual(t, created, mustConfigHashsum(t, configFile))
+
+	_, err = configHashsum(path.Join(dir, "not_exists"), nil)
+	assert.Error(t, err)
+}
+
+func TestNewExporter_invalidConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "watch")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer os.RemoveAll(dir)
+	assert.NoError(t, ioutil.WriteFile(path.Join(dir, "a.yaml"), []byte(watchTestConfig), 0644))
+	assert.NoError(t, ioutil.WriteFile(path.Join(dir, "b.yaml"), []byte("og_bad:\n  metrics:\n    - name: a\n      usage: WHAT\n"), 0644))
+
+	// valid files are loaded, while the invalid one is reported
+	e, err := NewExporter(WithConfig(dir))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer e.Close()
+	assert.Contains(t, e.GetMetricsList(), "og_tables_size")
+	value, _ := configStatus(t, e)
+	assert.Equal(t, float64(1), value)
+}
+
+func TestExporter_ReloadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "watch")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer os.RemoveAll(dir)
+	assert.NoError(t, ioutil.WriteFile(path.Join(dir, "a.yaml"), []byte(watchTestConfig), 0644))
+
+	e, err := NewExporter(WithConfig(dir), WithConfigWatch(10*time.Millisecond))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer e.Close()
+	assert.Contains(t, e.GetMetricsList(), "og_tables_size")
+	assert.Contains(t, e.GetMetricsList(), "pg_lock")
+	value, hashsum := configStatus(t, e)
+	assert.Equal(t, float64(0), value)
+	assert.Equal(t, mustConfigHashsum(t, dir), hashsum)
+
+	// invalid file is not swapped in
+	assert.NoError(t, ioutil.WriteFile(path.Join(dir, "b.yaml"), []byte("og_bad:\n  metrics:\n    - name: a\n      usage: WHAT\n"), 0644))
+	assert.Error(t, e.ReloadConfig())
+	value, _ = configStatus(t, e)
+	assert.Equal(t, float64(1), value)
+	assert.Contains(t, e.GetMetricsList(), "og_tables_size")
+
+	// new valid file is picked up by watcher
+	assert.NoError(t, ioutil.WriteFile(path.Join(dir, "b.yaml"), []byte("og_new:\n  query:\n    - sql: select 1 a\n  metrics:\n    - name: a\n      usage: GAUGE\n"), 0644))
+	for i := 0; i < 100; i++ {
+		if _, ok := e.GetMetricsList()["og_new"]; ok {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Contains(t, e.GetMetricsList(), "og_new")
+	assert.Contains(t, e.GetMetricsList(), "og_tables_size")
+	value, _ = configStatus(t, e)
+	assert.Equal(t, float64(0), value)
+}
+
+func TestExporter_ReloadConfig_concurrent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "watch")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer os.RemoveAll(dir)
+	assert.NoError(t, ioutil.WriteFile(path.Join(dir, "a.yaml"), []byte(watchTestConfig), 0644))
+
+	e, err := NewExporter(WithConfig(dir), WithDNS([]string{"host=localhost port=5432"}))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer e.Close()
+	server, err := e.servers.server("host=localhost port=5432")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// reloads overlapping with config changes leave exporter and servers on the same config
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_ = e.ReloadConfig()
+		}()
+		config := fmt.Sprintf("og_new_%d:\n  query:\n    - sql: select 1 a\n  metrics:\n    - name: a\n      usage: GAUGE\n", i)
+		assert.NoError(t, ioutil.WriteFile(path.Join(dir, "b.yaml"), []byte(config), 0644))
+	}
+	wg.Wait()
+	server.mappingMtx.RLock()
+	defer server.mappingMtx.RUnlock()
+	assert.Equal(t, e.GetMetricsList(), server.queryInstanceMap)
+}
@@ -8,8 +8,9 @@ package exporter
 
 var (
 	pgLock = &QueryInstance{
-		Name: "pg_lock",
-		Desc: "OpenGauss lock distribution by mode",
+		Name:  "pg_lock",
+		Scope: scopeCluster,
+		Desc:  "OpenGauss lock distribution by mode",
 		Queries: []*Query{
 			{
 				SupportedVersions: ">=0.0.0",
@@ -32,8 +33,10 @@ WHERE database IS NOT NULL GROUP BY database, mode) cnt USING (database, mode);`
 		},
 	}
 	pgStatReplication = &QueryInstance{
-		Name: "pg_stat_replication",
-		Desc: "",
+		Name:  "pg_stat_replication",
+		Scope: scopeCluster,
+		Desc:  "",
+		Role:  rolePrimary,
 		Queries: []*Query{
 			{
 				Name: "pg_stat_replication",
@@ -56,10 +59,10 @@ FROM pg_stat_replication`,
 			{Name: "backend_start", Usage: DISCARD, Desc: "with time zone      Time when this process was started, i.e., when the client connected to this WAL sender"},
 			{Name: "backend_xmin", Usage: DISCARD, Desc: "The current backend's xmin horizon."},
 			{Name: "state", Usage: LABEL, Desc: "Current WAL sender state"},
-			{Name: "sender_sent_location", Usage: DISCARD, Desc: "Last transaction log position sent on this connection"},
-			{Name: "receiver_write_location", Usage: DISCARD, Desc: "Last transaction log position written to disk by this standby server"},
-			{Name: "receiver_flush_location", Usage: DISCARD, Desc: "Last transaction log position flushed to disk by this standby server"},
-			{Name: "receiver_replay_location", Usage: DISCARD, Desc: "Last transaction log position replayed into the database on this standby server"},
+			{Name: "sender_sent_location", Usage: LSN, Desc: "Last transaction log position sent on this connection"},
+			{Name: "receiver_write_location", Usage: LSN, Desc: "Last transaction log position written to disk by this standby server"},
+			{Name: "receiver_flush_location", Usage: LSN, Desc: "Last transaction log position flushed to disk by this standby server"},
+			{Name: "receiver_replay_location", Usage: LSN, Desc: "Last transaction log position replayed into the database on this standby server"},
 			{Name: "sync_priority", Usage: DISCARD, Desc: "Priority of this standby server for being chosen as the synchronous standby"},
 			{Name: "sync_state", Usage: DISCARD, Desc: "Synchronous state of this standby server"},
 			{Name: "pg_current_xlog_location", Usage: DISCARD, Desc: "pg_current_xlog_location"},
@@ -72,8 +75,6 @@ FROM pg_stat_replication`,
 			{Name: "write_lsn", Usage: DISCARD, Desc: "Last transaction log position written to disk by this standby server"},
 			{Name: "flush_lsn", Usage: DISCARD, Desc: "Last transaction log position flushed to disk by this standby server"},
 			{Name: "replay_lsn", Usage: DISCARD, Desc: "Last transaction log position replayed into the database on this standby server"},
-			{Name: "sync_priority", Usage: DISCARD, Desc: "Priority of this standby server for being chosen as the synchronous standby"},
-			{Name: "sync_state", Usage: DISCARD, Desc: "Synchronous state of this standby server"},
 			{Name: "slot_name", Usage: LABEL, Desc: "A unique, cluster-wide identifier for the replication slot"},
 			{Name: "plugin", Usage: DISCARD, Desc: "The base name of the shared object containing the output plugin this logical slot is using, or null for physical slots"},
 			{Name: "slot_type", Usage: DISCARD, Desc: "The slot type - physical or logical"},
@@ -84,10 +85,8 @@ FROM pg_stat_replication`,
 			{Name: "xmin", Usage: DISCARD, Desc: "The oldest transaction that this slot needs the database to retain. VACUUM cannot remove tuples deleted by any later transaction"},
 			{Name: "catalog_xmin", Usage: DISCARD, Desc: "The oldest transaction affecting the system catalogs that this slot needs the database to retain. VACUUM cannot remove catalog tuples deleted by any later transaction"},
 			{Name: "restart_lsn", Usage: DISCARD, Desc: "The address (LSN) of oldest WAL which still might be required by the consumer of this slot and thus won't be automatically removed during checkpoints"},
-			{Name: "pg_current_xlog_location", Usage: DISCARD, Desc: "pg_current_xlog_location"},
 			{Name: "pg_current_wal_lsn", Usage: DISCARD, Desc: "pg_current_xlog_location"},
 			{Name: "pg_current_wal_lsn_bytes", Usage: GAUGE, Desc: "WAL position in bytes"},
-			{Name: "pg_xlog_location_diff", Usage: GAUGE, Desc: "Lag in bytes between master and slave"},
 			{Name: "pg_wal_lsn_diff", Usage: GAUGE, Desc: "Lag in bytes between master and slave"},
 			{Name: "confirmed_flush_lsn", Usage: DISCARD, Desc: "LSN position a consumer of a slot has confirmed flushing the data received"},
 			{Name: "write_lag", Usage: DISCARD, Desc: "Time elapsed between flushing recent WAL locally and receiving notification that this standby server has written it (but not yet flushed it or applied it). This can be used to gauge the delay that synchronous_commit level remote_write incurred while committing if this server was configured as a synchronous standby."},
@@ -96,8 +95,9 @@ FROM pg_stat_replication`,
 		},
 	}
 	pgStatActivity = &QueryInstance{
-		Name: "pg_stat_activity",
-		Desc: "OpenGauss backend activity group by state",
+		Name:  "pg_stat_activity",
+		Scope: scopeCluster,
+		Desc:  "OpenGauss backend activity group by state",
 		Queries: []*Query{
 			{
 				SQL: `SELECT datname,
@@ -132,8 +132,9 @@ FROM (SELECT d.oid AS database, d.datname, a.state
 		},
 	}
 	pgDatabase = &QueryInstance{
-		Name: "pg_database",
-		Desc: "OpenGauss Database size",
+		Name:  "pg_database",
+		Scope: scopeCluster,
+		Desc:  "OpenGauss Database size",
 		Queries: []*Query{
 			{
 				SQL:               `SELECT pg_database.datname, pg_database_size(pg_database.datname) as size_bytes FROM pg_database where datname NOT IN ('template0','template1')`,
@@ -146,8 +147,9 @@ FROM (SELECT d.oid AS database, d.datname, a.state
 		},
 	}
 	pgStatBgWriter = &QueryInstance{
-		Name: "pg_stat_bgwriter",
-		Desc: "OpenGauss background writer metrics",
+		Name:  "pg_stat_bgwriter",
+		Scope: scopeCluster,
+		Desc:  "OpenGauss background writer metrics",
 		Queries: []*Query{
 			{
 				SQL: `SELECT checkpoints_timed,
@@ -168,20 +170,21 @@ FROM pg_stat_bgwriter`,
 		Metrics: []*Column{
 			{Name: "checkpoints_timed", Usage: COUNTER, Desc: "scheduled checkpoints that have been performed"},
 			{Name: "checkpoints_req", Usage: COUNTER, Desc: "requested checkpoints that have been performed"},
-			{Name: "checkpoint_write_time", Usage: COUNTER, Desc: "time spending on writing files to disk, in µs"},
-			{Name: "checkpoint_sync_time", Usage: COUNTER, Desc: "time spending on syncing files to disk, in µs"},
-			{Name: "buffers_checkpoint", Usage: COUNTER, Desc: "buffers written during checkpoints"},
-			{Name: "buffers_clean", Usage: COUNTER, Desc: "buffers written by the background writer"},
-			{Name: "buffers_backend", Usage: COUNTER, Desc: "buffers written directly by a backend"},
+			{Name: "checkpoint_write_time", Usage: COUNTER, Unit: "ms", Desc: "time spending on writing files to disk"},
+			{Name: "checkpoint_sync_time", Usage: COUNTER, Unit: "ms", Desc: "time spending on syncing files to disk"},
+			{Name: "buffers_checkpoint", Usage: COUNTER, Unit: "8kB", Desc: "buffers written during checkpoints"},
+			{Name: "buffers_clean", Usage: COUNTER, Unit: "8kB", Desc: "buffers written by the background writer"},
+			{Name: "buffers_backend", Usage: COUNTER, Unit: "8kB", Desc: "buffers written directly by a backend"},
 			{Name: "maxwritten_clean", Usage: COUNTER, Desc: "times that bgwriter stopped a cleaning scan"},
 			{Name: "buffers_backend_fsync", Usage: COUNTER, Desc: "times a backend had to execute its own fsync"},
-			{Name: "buffers_alloc", Usage: COUNTER, Desc: "buffers allocated"},
+			{Name: "buffers_alloc", Usage: COUNTER, Unit: "8kB", Desc: "buffers allocated"},
 			{Name: "stats_reset", Usage: COUNTER, Desc: "time when statistics were last reset"},
 		},
 	}
 	pgStatDatabase = &QueryInstance{
-		Name: "pg_stat_database",
-		Desc: "OpenGauss database statistics",
+		Name:  "pg_stat_database",
+		Scope: scopeCluster,
+		Desc:  "OpenGauss database statistics",
 		Queries: []*Query{
 			{
 				SQL:               "select * from pg_stat_database where datname NOT IN ('template0','template1')",
@@ -211,8 +214,9 @@ FROM pg_stat_bgwriter`,
 		},
 	}
 	pgStatDatabaseConflicts = &QueryInstance{
-		Name: "pg_stat_database_conflicts",
-		Desc: "OpenGauss database statistics conflicts",
+		Name:  "pg_stat_database_conflicts",
+		Scope: scopeCluster,
+		Desc:  "OpenGauss database statistics conflicts",
 		Queries: []*Query{
 			{
 				SQL:               "select * from pg_stat_database_conflicts where datname NOT IN ('template0','template1')",
@@ -0,0 +1,61 @@
+// Copyright © 2020 Bin Liu <bin.liu@enmotech.com>
+
+package exporter
+
+import (
+	"math"
+	"time"
+)
+
+// deltaStaleAfter is how long a previous sample is kept without being updated
+const deltaStaleAfter = time.Hour
+
+// deltaSample holds the previous value of a DELTA/RATE series
+type deltaSample struct {
+	value     float64
+	timestamp time.Time
+}
+
+// deltaValue record the current value of a counter series identified by key,
+// and return its increase (or per-second rate) since the previous call.
+// ok is false on first sight of a series, as there is nothing to compare with.
+// A value lower than the previous one means counter reset (stats reset or
+// restart), in which case the current value is taken as the increase.
+func (s *Server) deltaValue(key string, rate bool, value float64, now time.Time) (float64, bool) {
+	s.deltaMtx.Lock()
+	defer s.deltaMtx.Unlock()
+	if s.deltaSamples == nil {
+		s.deltaSamples = make(map[string]deltaSample)
+	}
+	prev, found := s.deltaSamples[key]
+	if math.IsNaN(value) {
+		return 0, false
+	}
+	s.deltaSamples[key] = deltaSample{value: value, timestamp: now}
+	if !found || math.IsNaN(prev.value) {
+		return 0, false
+	}
+	delta := value - prev.value
+	if delta < 0 {
+		delta = value
+	}
+	if !rate {
+		return delta, true
+	}
+	elapsed := now.Sub(prev.timestamp).Seconds()
+	if elapsed <= 0 {
+		return 0, false
+	}
+	return delta / elapsed, true
+}
+
+// pruneDeltaSamples drop previous samples of series not seen for a while
+func (s *Server) pruneDeltaSamples(now time.Time) {
+	s.deltaMtx.Lock()
+	defer s.deltaMtx.Unlock()
+	for key, sample := range s.deltaSamples {
+		if now.Sub(sample.timestamp) > deltaStaleAfter {
+			delete(s.deltaSamples, key)
+		}
+	}
+}
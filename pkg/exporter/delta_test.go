@@ -0,0 +1,37 @@
+// Copyright © 2020 Bin Liu <bin.liu@enmotech.com>
+
+package exporter
+
+import (
+	"github.com/stretchr/testify/assert"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestServer_deltaValue(t *testing.T) {
+	s := &Server{}
+	now := time.Unix(1600000000, 0)
+
+	_, ok := s.deltaValue("a", false, 10, now)
+	assert.False(t, ok, "first sample")
+	v, ok := s.deltaValue("a", false, 25, now.Add(15*time.Second))
+	assert.True(t, ok)
+	assert.Equal(t, float64(15), v)
+	v, ok = s.deltaValue("a", false, 5, now.Add(30*time.Second))
+	assert.True(t, ok)
+	assert.Equal(t, float64(5), v, "counter reset")
+	_, ok = s.deltaValue("a", false, math.NaN(), now.Add(45*time.Second))
+	assert.False(t, ok)
+
+	_, ok = s.deltaValue("b", true, 100, now)
+	assert.False(t, ok)
+	v, ok = s.deltaValue("b", true, 130, now.Add(15*time.Second))
+	assert.True(t, ok)
+	assert.Equal(t, float64(2), v)
+	_, ok = s.deltaValue("b", true, 130, now.Add(15*time.Second))
+	assert.False(t, ok, "no elapsed time")
+
+	s.pruneDeltaSamples(now.Add(time.Minute + deltaStaleAfter))
+	assert.Empty(t, s.deltaSamples)
+}
@@ -167,3 +167,24 @@ func genDSNString(connStringSettings map[string]string) string {
 	sort.Strings(kvs) // Makes testing easier (not a performance concern)
 	return strings.Join(kvs, " ")
 }
+
+// dsnTagsKey is the dsn parameter holding per target server tags, separated by ';'
+const dsnTagsKey = "tags"
+
+// splitDSNTags extract server tags from dsn and returns the dsn without them,
+// as the tags parameter is not a connection setting
+func splitDSNTags(dsn string) (string, []string, error) {
+	if !strings.Contains(dsn, dsnTagsKey+"=") {
+		return dsn, nil, nil
+	}
+	settings, err := parseDsn(dsn)
+	if err != nil {
+		return "", nil, err
+	}
+	tagStr, ok := settings[dsnTagsKey]
+	if !ok {
+		return dsn, nil, nil
+	}
+	delete(settings, dsnTagsKey)
+	return genDSNString(settings), parseCSV(strings.Replace(tagStr, ";", ",", -1)), nil
+}
@@ -2,6 +2,11 @@
 
 package exporter
 
+import (
+	"errors"
+	"github.com/lib/pq"
+)
+
 type ErrorConnectToServer struct {
 	Msg string
 }
@@ -10,3 +15,54 @@ type ErrorConnectToServer struct {
 func (e *ErrorConnectToServer) Error() string {
 	return e.Msg
 }
+
+// ErrorParseValue is returned for a column value that can not be converted to float64
+type ErrorParseValue struct {
+	Msg string
+}
+
+// Error returns error
+func (e *ErrorParseValue) Error() string {
+	return e.Msg
+}
+
+// ErrorQueryTimeout is returned for a query stopped by its timeout, either by context or by database
+type ErrorQueryTimeout struct {
+	Msg string
+}
+
+// Error returns error
+func (e *ErrorQueryTimeout) Error() string {
+	return e.Msg
+}
+
+// classes of query errors
+const (
+	errClassTimeout    = "timeout"
+	errClassPermission = "permission"
+	errClassSyntax     = "syntax"
+	errClassParse      = "parse"
+	errClassOther      = "other"
+)
+
+var errClasses = []string{errClassTimeout, errClassPermission, errClassSyntax, errClassParse, errClassOther}
+
+// classifyError returns class of a query error
+func classifyError(err error) string {
+	var (
+		timeoutErr *ErrorQueryTimeout
+		parseErr   *ErrorParseValue
+		pqErr      *pq.Error
+	)
+	switch {
+	case errors.As(err, &timeoutErr):
+		return errClassTimeout
+	case errors.As(err, &parseErr):
+		return errClassParse
+	case errors.As(err, &pqErr) && pqErr.Code == "42501": // insufficient_privilege
+		return errClassPermission
+	case errors.As(err, &pqErr) && pqErr.Code.Class() == "42": // syntax error or access rule violation
+		return errClassSyntax
+	}
+	return errClassOther
+}
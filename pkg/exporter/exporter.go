@@ -7,21 +7,35 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/common/log"
 	"strings"
+	"sync"
 	"time"
 )
 
 type Exporter struct {
 	dsn                    []string
-	configPath             string   // config file path /directory
-	disableCache           bool     // always execute query when been scrapped
-	autoDiscovery          bool     // discovery other database on primary server
-	failFast               bool     // fail fast instead fof waiting during start-up ?
-	excludedDatabases      []string // excluded database for auto discovery
+	configPath             string            // config file path /directory
+	configVars             map[string]string // template variables of config files
+	disableCache           bool              // always execute query when been scrapped
+	autoDiscovery          bool              // discovery other database on primary server
+	failFast               bool              // fail fast instead fof waiting during start-up ?
+	excludedDatabases      []string          // excluded database for auto discovery
 	disableSettingsMetrics bool
 	tags                   []string
 	namespace              string
 	servers                *Servers
 	metricMap              map[string]*QueryInstance
+	metricMtx              sync.RWMutex
+	configWatchInterval    time.Duration // poll config path for changes, 0 means disabled
+	backgroundCollect      bool          // run queries by scheduler in background, scrapes serve latest snapshot
+	scrapeConcurrency      int           // max number of targets scraped at the same time
+	maxOpenConns           int           // max open connections per target, also max queries running at the same time
+	maxIdleConns           int
+	connMaxLifetime        time.Duration
+	scrapeBudget           time.Duration // max execution time of queries per target and scrape, 0 means unlimited
+	targets                [][]string    // background collection: dsn of every scheduled target per dsn
+	targetsMtx             sync.Mutex
+	reloadMtx              sync.Mutex // serializes config reloads from watcher, SIGHUP and /reload
+	done                   chan struct{}
 
 	constantLabels  prometheus.Labels    // 用户定义标签
 	duration        prometheus.Gauge     // 采集时间
@@ -35,57 +49,87 @@ type Exporter struct {
 // NewExporter New Exporter
 func NewExporter(opts ...Opt) (e *Exporter, err error) {
 	e = &Exporter{
-		metricMap: defaultMonList, // default metric
+		done:         make(chan struct{}),
+		maxOpenConns: 1,
+		maxIdleConns: 1,
 	}
 	for _, opt := range opts {
 		opt(e)
 	}
 
 	e.initDefaultMetric()
+	e.setupInternalMetrics()
 
-	if err := e.loadConfig(); err != nil {
+	var hashsum string
+	if e.metricMap, hashsum, err = e.loadConfig(false); err != nil {
 		return nil, err
 	}
-	e.setupInternalMetrics()
 	e.setupServers()
+	if e.backgroundCollect {
+		e.startBackground()
+	}
+	if e.configPath != "" && e.configWatchInterval > 0 {
+		go e.watchConfig(e.configWatchInterval, hashsum)
+	}
 	return e, nil
 }
 
 // initDefaultMetric init default metric
 func (e *Exporter) initDefaultMetric() {
-	for _, q := range e.metricMap {
+	for _, q := range defaultMonList {
 		_ = q.Check()
 	}
 }
 
-// loadConfig Load the configuration file, the same indicator in the configuration file overwrites the default configuration
+// loadConfig Load the configuration file, the same indicator in the configuration file overwrites the default configuration.
+// It returns merged queries and hashsum of config files. Without strict, invalid files in config dir are skipped,
+// while still reported by config load error.
 // 加载配置文件,配置文件里相同指标覆盖默认配置
-func (e *Exporter) loadConfig() error {
+func (e *Exporter) loadConfig(strict bool) (map[string]*QueryInstance, string, error) {
+	metricMap := make(map[string]*QueryInstance, len(defaultMonList))
+	for name, query := range defaultMonList {
+		metricMap[name] = query
+	}
 	if e.configPath == "" {
-		return nil
+		return metricMap, "", nil
 	}
-	queryList, err := LoadConfig(e.configPath)
+	hashsum, err := configHashsum(e.configPath, e.configVars)
 	if err != nil {
-		return err
+		e.setConfigStatus(hashsum, err)
+		return nil, hashsum, err
+	}
+	// config status reports any invalid file, even if it is skipped
+	queryList, err := loadConfig(e.configPath, e.configVars, true)
+	e.setConfigStatus(hashsum, err)
+	if err != nil {
+		if strict {
+			return nil, hashsum, err
+		}
+		log.Warnf("config %s is invalid, loading valid files only: %s", e.configPath, err)
+		if queryList, err = loadConfig(e.configPath, e.configVars, false); err != nil {
+			return nil, hashsum, err
+		}
 	}
 	for name, query := range queryList {
 		var found bool
-		for defName, defQuery := range e.metricMap {
+		for defName, defQuery := range metricMap {
 			if strings.EqualFold(defQuery.Name, query.Name) {
-				e.metricMap[defName] = query
+				metricMap[defName] = query
 				found = true
 				break
 			}
 		}
 		if !found {
-			e.metricMap[name] = query
+			metricMap[name] = query
 		}
 	}
-	return nil
+	return metricMap, hashsum, nil
 }
 
 // GetMetricsList Get Metrics List
 func (e *Exporter) GetMetricsList() map[string]*QueryInstance {
+	e.metricMtx.RLock()
+	defer e.metricMtx.RUnlock()
 	if e.metricMap == nil {
 		return nil
 	}
@@ -138,6 +182,10 @@ func (e *Exporter) setupServers() {
 		ServerWithDisableSettingsMetrics(e.disableSettingsMetrics),
 		ServerWithDisableCache(e.disableCache),
 		ServerWithTimeToString(e.timeToString),
+		ServerWithTags(e.tags),
+		ServerWithBackground(e.backgroundCollect),
+		ServerWithPool(e.maxOpenConns, e.maxIdleConns, e.connMaxLifetime),
+		ServerWithScrapeBudget(e.scrapeBudget),
 	)
 }
 
@@ -185,25 +233,30 @@ func (e *Exporter) scrape(ch chan<- prometheus.Metric) {
 	e.totalScrapes.Inc()
 
 	dsnList := e.dsn
-	if e.autoDiscovery {
+	switch {
+	case e.backgroundCollect:
+		dsnList = e.backgroundTargets()
+	case e.autoDiscovery:
 		dsnList = e.discoverDatabaseDSNs()
 	}
 
 	var errorsCount int
 	var connectionErrorsCount int
+	var countMtx sync.Mutex
 
-	for _, dsn := range dsnList {
-		log.Debugf(dsn)
+	e.forEachDSN(dsnList, func(_ int, dsn string) {
+		log.Debugf(ShadowDSN(dsn))
 		if err := e.scrapeDSN(ch, dsn); err != nil {
-			errorsCount++
-
 			log.Errorf(err.Error())
 
+			countMtx.Lock()
+			defer countMtx.Unlock()
+			errorsCount++
 			if _, ok := err.(*ErrorConnectToServer); ok {
 				connectionErrorsCount++
 			}
 		}
-	}
+	})
 
 	switch {
 	case connectionErrorsCount >= len(dsnList):
@@ -222,39 +275,63 @@ func (e *Exporter) scrape(ch chan<- prometheus.Metric) {
 
 func (e *Exporter) discoverDatabaseDSNs() []string {
 	result := []string{}
-	for _, dsn := range e.dsn {
+	for _, dsnList := range e.discoverDatabases() {
+		result = append(result, dsnList...)
+	}
+	return result
+}
+
+// discoverDatabases returns dsn of every database per dsn, nil for a dsn whose databases could not be discovered
+func (e *Exporter) discoverDatabases() [][]string {
+	discovered := make([][]string, len(e.dsn)) // keep the order of dsn
+	e.forEachDSN(e.dsn, func(i int, dsn string) {
 		parsedDSN, err := parseDsn(dsn)
 		if err != nil {
 			log.Errorf("Unable to parse DSN (%s): %v", ShadowDSN(dsn), err)
-			continue
+			return
 		}
 		server, err := e.servers.GetServer(dsn)
 		if err != nil {
 			log.Errorf("Error opening connection to database (%s): %v", ShadowDSN(dsn), err)
-			continue
+			return
 		}
 
 		// If autoDiscoverDatabases is true, set first dsn as master database (Default: false)
-		server.master = true
+		server.setMaster()
 
 		databaseNames, err := server.QueryDatabases()
 		if err != nil {
 			log.Errorf("Error querying databases (%s): %v", ShadowDSN(dsn), err)
-			continue
+			return
+		}
+		// Cluster scope queries run on the database given in dsn only
+		clusterDSN := genDSNString(parsedDSN)
+		if clusterServer, err := e.servers.GetServer(clusterDSN); err == nil {
+			clusterServer.setMaster()
 		}
-		result = append(result, genDSNString(parsedDSN))
+		discovered[i] = append(discovered[i], clusterDSN)
 		for _, databaseName := range databaseNames {
 			if Contains(e.excludedDatabases, databaseName) {
 				continue
 			}
 			parsedDSN["database"] = databaseName
-			result = append(result, genDSNString(parsedDSN))
+			discovered[i] = append(discovered[i], genDSNString(parsedDSN))
 		}
-	}
-	return result
+	})
+	return discovered
+}
+
+// forEachDSN calls fn for every dsn, with at most scrapeConcurrency calls running at the same time
+func (e *Exporter) forEachDSN(dsnList []string, fn func(i int, dsn string)) {
+	forEachLimit(len(dsnList), e.scrapeConcurrency, func(i int) {
+		fn(i, dsnList[i])
+	})
 }
 
 func (e *Exporter) scrapeDSN(ch chan<- prometheus.Metric, dsn string) error {
+	if e.backgroundCollect {
+		return e.scrapeBackground(ch, dsn)
+	}
 	server, err := e.servers.GetServer(dsn)
 
 	if err != nil {
@@ -263,7 +340,7 @@ func (e *Exporter) scrapeDSN(ch chan<- prometheus.Metric, dsn string) error {
 
 	// Check if autoDiscoverDatabases is false, set dsn as master database (Default: false)
 	if !e.autoDiscovery {
-		server.master = true
+		server.setMaster()
 	}
 
 	// Check if map versions need to be updated
@@ -271,38 +348,19 @@ func (e *Exporter) scrapeDSN(ch chan<- prometheus.Metric, dsn string) error {
 		log.Warnln("Proceeding with outdated query maps, as the OpenGauss version could not be determined:", err)
 	}
 
+	// Check replication role, so that only queries for this role are executed
+	if err := server.QueryRole(); err != nil {
+		log.Warnln("Proceeding with queries of any role, as the replication role could not be determined:", err)
+	}
+
 	return server.Scrape(ch)
 }
 
 func (e *Exporter) checkMapVersions(ch chan<- prometheus.Metric, server *Server) error {
-	log.Debugf("Querying OpenGauss Version on %q", server)
-	versionRow := server.db.QueryRow("SELECT version();")
-	var versionString string
-	err := versionRow.Scan(&versionString)
-	if err != nil {
-		return fmt.Errorf("Error scanning version string on %q: %v ", server, err)
-	}
-	semanticVersion, err := parseVersionSem(versionString)
-	if err != nil {
-		return fmt.Errorf("Error parsing version string on %q: %v ", server, err)
-	}
-	// Check if semantic version changed and recalculate maps if needed.
-	if semanticVersion.NE(server.lastMapVersion) || server.queryInstanceMap == nil {
-		log.Infof("Semantic Version Changed on %s: %s -> %s", server, server.lastMapVersion, semanticVersion)
-		server.mappingMtx.Lock()
-		server.queryInstanceMap = e.metricMap
-		server.lastMapVersion = semanticVersion
-		server.mappingMtx.Unlock()
-
-	}
-
-	versionDesc := prometheus.NewDesc(fmt.Sprintf("%s_%s", e.namespace, staticLabelName),
-		"Version string as reported by OpenGauss", []string{"version", "short_version"}, server.labels)
-
-	if server.master {
-		ch <- prometheus.MustNewConstMetric(versionDesc,
-			prometheus.UntypedValue, 1, parseVersion(versionString), semanticVersion.String())
+	if err := server.checkVersion(ch); err != nil {
+		return err
 	}
+	server.initQueryInstanceMap(e.GetMetricsList())
 	return nil
 }
 
@@ -311,5 +369,6 @@ func (e *Exporter) Check() error {
 }
 
 func (e *Exporter) Close() {
+	close(e.done)
 	e.servers.Close()
 }
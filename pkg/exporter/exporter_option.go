@@ -4,6 +4,7 @@ package exporter
 
 import (
 	"strings"
+	"time"
 )
 
 // ExporterOpt configures Exporter
@@ -23,6 +24,49 @@ func WithConfig(configPath string) Opt {
 	}
 }
 
+// WithConfigVars set template variables of config files, a list of key=value separated by comma
+func WithConfigVars(s string) Opt {
+	return func(e *Exporter) {
+		e.configVars = ParseConfigVars(s)
+	}
+}
+
+// WithConfigWatch reloads config when files under config path changed, checked every interval. 0 disables it.
+func WithConfigWatch(interval time.Duration) Opt {
+	return func(e *Exporter) {
+		e.configWatchInterval = interval
+	}
+}
+
+// WithBackgroundCollect runs queries by a scheduler on their own intervals, scrapes serve the latest snapshot only
+func WithBackgroundCollect(b bool) Opt {
+	return func(e *Exporter) {
+		e.backgroundCollect = b
+	}
+}
+
+// WithScrapeConcurrency limits number of targets scraped at the same time
+func WithScrapeConcurrency(n int) Opt {
+	return func(e *Exporter) {
+		e.scrapeConcurrency = n
+	}
+}
+
+// WithPool configures connection pool of every target. maxOpenConns is also the number of queries
+// executed at the same time on a target.
+func WithPool(maxOpenConns, maxIdleConns int, connMaxLifetime time.Duration) Opt {
+	return func(e *Exporter) {
+		e.maxOpenConns, e.maxIdleConns, e.connMaxLifetime = maxOpenConns, maxIdleConns, connMaxLifetime
+	}
+}
+
+// WithScrapeBudget limits total execution time of queries per target during a scrape, 0 means unlimited
+func WithScrapeBudget(budget time.Duration) Opt {
+	return func(e *Exporter) {
+		e.scrapeBudget = budget
+	}
+}
+
 // WithConstLabels add const label to exporter. 0 length label returns nil
 func WithConstLabels(s string) Opt {
 	return func(e *Exporter) {
@@ -0,0 +1,399 @@
+// Copyright © 2021 Bin Liu <bin.liu@enmotech.com>
+
+package exporter
+
+import (
+	"fmt"
+	"github.com/blang/semver"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// LintError is a problem found in a config file
+type LintError struct {
+	File  string
+	Line  int // 0 if unknown
+	Query string
+	Msg   string
+}
+
+// Error returns error
+func (e *LintError) Error() string {
+	var b strings.Builder
+	b.WriteString(e.File)
+	if e.Line > 0 {
+		fmt.Fprintf(&b, ":%d", e.Line)
+	}
+	if e.Query != "" {
+		fmt.Fprintf(&b, ": %s", e.Query)
+	}
+	fmt.Fprintf(&b, ": %s", e.Msg)
+	return b.String()
+}
+
+var (
+	yamlLineRegexp   = regexp.MustCompile(`^line (\d+): (.*)$`)
+	checkColRegexp   = regexp.MustCompile(`^column (\S+) `)
+	versionNumRegexp = regexp.MustCompile(`\d+(\.\d+){0,2}`)
+)
+
+// lintQuery is a parsed query instance with where it comes from
+type lintQuery struct {
+	key   string
+	file  string
+	lines *configLines
+	query *QueryInstance
+}
+
+// LintConfig validates every config file in path rendered with vars, returns all problems found
+func LintConfig(configPath string, vars map[string]string) []*LintError {
+	stat, err := os.Stat(configPath)
+	if err != nil {
+		return []*LintError{{File: configPath, Msg: fmt.Sprintf("invalid config path: %s", err)}}
+	}
+	files := []string{configPath}
+	if stat.IsDir() {
+		entries, err := ioutil.ReadDir(configPath)
+		if err != nil {
+			return []*LintError{{File: configPath, Msg: fmt.Sprintf("fail reading config dir: %s", err)}}
+		}
+		files = files[:0]
+		for _, entry := range entries {
+			if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".yaml") {
+				continue
+			}
+			files = append(files, path.Join(configPath, entry.Name()))
+		}
+	}
+
+	var (
+		lintErrors []*LintError
+		queries    = make(map[string]*lintQuery)
+	)
+	for _, file := range files {
+		content, err := ioutil.ReadFile(file)
+		if err != nil {
+			lintErrors = append(lintErrors, &LintError{File: file, Msg: err.Error()})
+			continue
+		}
+		fileQueries, errs := lintContent(content, file, vars)
+		lintErrors = append(lintErrors, errs...)
+		for key, q := range fileQueries {
+			queries[key] = q // later file overwrites former one, same as LoadConfig
+		}
+	}
+	lintErrors = append(lintErrors, lintMetricNames(queries)...)
+
+	sort.SliceStable(lintErrors, func(i, j int) bool {
+		if lintErrors[i].File != lintErrors[j].File {
+			return lintErrors[i].File < lintErrors[j].File
+		}
+		return lintErrors[i].Line < lintErrors[j].Line
+	})
+	return lintErrors
+}
+
+// lintContent validates a single config file, returns valid queries and all problems found
+func lintContent(content []byte, file string, vars map[string]string) (map[string]*lintQuery, []*LintError) {
+	var lintErrors []*LintError
+	content, err := renderConfig(content, file, vars)
+	if err != nil {
+		return nil, []*LintError{{File: file, Msg: err.Error()}}
+	}
+	queries := make(map[string]*QueryInstance)
+	if err := yaml.UnmarshalStrict(content, &queries); err != nil {
+		typeErr, ok := err.(*yaml.TypeError)
+		if !ok { // syntax error, nothing more could be checked
+			return nil, []*LintError{yamlLintError(file, strings.TrimPrefix(err.Error(), "yaml: "))}
+		}
+		// unknown keys and mismatched types, the rest of file is still decoded
+		for _, msg := range typeErr.Errors {
+			lintErrors = append(lintErrors, yamlLintError(file, msg))
+		}
+	}
+
+	lines := newConfigLines(content)
+	result := make(map[string]*lintQuery, len(queries))
+	for key, q := range queries {
+		if q == nil {
+			lintErrors = append(lintErrors, &LintError{File: file, Line: lines.query(key), Query: key, Msg: "empty query"})
+			continue
+		}
+		q.Path = path.Base(file)
+		if q.Name == "" {
+			q.Name = key
+		}
+		errs, ok := lintVersions(key, q, file, lines)
+		lintErrors = append(lintErrors, errs...)
+		if !ok {
+			continue
+		}
+		seen := make(map[string]bool, len(q.Metrics))
+		for _, column := range q.Metrics {
+			if seen[column.Name] {
+				lintErrors = append(lintErrors, &LintError{File: file, Line: lines.column(key, column.Name, 1), Query: key,
+					Msg: fmt.Sprintf("column %s is defined more than once", column.Name)})
+			}
+			seen[column.Name] = true
+		}
+		if err := q.loadSQLFiles(filepath.Dir(file), vars); err != nil {
+			lintErrors = append(lintErrors, &LintError{File: file, Line: lines.query(key), Query: key, Msg: err.Error()})
+		}
+		if errs := q.check(); len(errs) > 0 {
+			for _, err := range errs {
+				line := lines.query(key)
+				if m := checkColRegexp.FindStringSubmatch(err.Error()); m != nil {
+					line = lines.column(key, m[1], 0)
+				}
+				lintErrors = append(lintErrors, &LintError{File: file, Line: line, Query: key, Msg: err.Error()})
+			}
+			continue
+		}
+		result[key] = &lintQuery{key: key, file: file, lines: lines, query: q}
+	}
+	return result, lintErrors
+}
+
+func yamlLintError(file, msg string) *LintError {
+	if m := yamlLineRegexp.FindStringSubmatch(msg); m != nil {
+		line, _ := strconv.Atoi(m[1])
+		return &LintError{File: file, Line: line, Msg: m[2]}
+	}
+	return &LintError{File: file, Msg: msg}
+}
+
+// lintVersions checks version range of each query branch, and that ranges do not overlap.
+// It returns false if any range is invalid, which would fail the query check as well.
+func lintVersions(key string, q *QueryInstance, file string, lines *configLines) ([]*LintError, bool) {
+	var lintErrors []*LintError
+	ranges := make([]semver.Range, len(q.Queries))
+	for i, query := range q.Queries {
+		if query.SupportedVersions == "" {
+			query.SupportedVersions = defaultVersion
+		}
+		r, err := semver.ParseRange(query.SupportedVersions)
+		if err != nil {
+			lintErrors = append(lintErrors, &LintError{File: file, Line: lines.version(key, i), Query: key,
+				Msg: fmt.Sprintf("invalid version range %q: %s", query.SupportedVersions, err)})
+			continue
+		}
+		ranges[i] = r
+	}
+	if len(lintErrors) > 0 {
+		return lintErrors, false
+	}
+	for i := range q.Queries {
+		for j := i + 1; j < len(q.Queries); j++ {
+			if v, ok := rangesOverlap(q.Queries[i].SupportedVersions, ranges[i], q.Queries[j].SupportedVersions, ranges[j]); ok {
+				lintErrors = append(lintErrors, &LintError{File: file, Line: lines.version(key, j), Query: key,
+					Msg: fmt.Sprintf("version range %q overlaps with %q (e.g. %s), only the first one is used",
+						q.Queries[j].SupportedVersions, q.Queries[i].SupportedVersions, v)})
+			}
+		}
+	}
+	return lintErrors, true
+}
+
+// rangesOverlap probes versions around every bound of two ranges, returns a version satisfying both
+func rangesOverlap(s1 string, r1 semver.Range, s2 string, r2 semver.Range) (semver.Version, bool) {
+	probes := []semver.Version{{}}
+	for _, num := range versionNumRegexp.FindAllString(s1+" "+s2, -1) {
+		v, err := semver.ParseTolerant(num)
+		if err != nil {
+			continue
+		}
+		probes = append(probes, v,
+			semver.Version{Major: v.Major, Minor: v.Minor, Patch: v.Patch + 1},
+			semver.Version{Major: v.Major, Minor: v.Minor + 1},
+			semver.Version{Major: v.Major + 1})
+		if v.Patch > 0 {
+			probes = append(probes, semver.Version{Major: v.Major, Minor: v.Minor, Patch: v.Patch - 1})
+		}
+	}
+	sort.Slice(probes, func(i, j int) bool { return probes[i].LT(probes[j]) })
+	for _, v := range probes {
+		if r1(v) && r2(v) {
+			return v, true
+		}
+	}
+	return semver.Version{}, false
+}
+
+// lintMetricNames checks that metric names are not published by more than one query. Names of
+// pivot metrics are only known at runtime, so any name under the prefix of a pivot query is reported.
+func lintMetricNames(queries map[string]*lintQuery) []*LintError {
+	keys := make([]string, 0, len(queries))
+	for key := range queries {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var lintErrors []*LintError
+	owners := make(map[string]string)
+	pivotPrefixes := make(map[string]string)
+	for _, key := range keys {
+		lq := queries[key]
+		q := lq.query
+		names := make(map[string]string, len(q.MetricNames))
+		for _, colName := range q.MetricNames {
+			for _, name := range q.publishedNames(q.Columns[colName]) {
+				names[name] = colName
+			}
+		}
+		if q.Info {
+			names[q.Prefix()+"_info"] = ""
+		}
+		if q.KeyColumn != "" {
+			if owner, ok := pivotPrefixes[q.Prefix()+"_"]; ok {
+				lintErrors = append(lintErrors, lintNameError(lq, "",
+					fmt.Sprintf("pivot metrics %s_* are also published by pivot query %s", q.Prefix(), owner)))
+			} else {
+				pivotPrefixes[q.Prefix()+"_"] = key
+			}
+		}
+		metricNames := make([]string, 0, len(names))
+		for name := range names {
+			metricNames = append(metricNames, name)
+		}
+		sort.Strings(metricNames)
+		for _, name := range metricNames {
+			if owner, ok := owners[name]; ok {
+				lintErrors = append(lintErrors, lintNameError(lq, names[name],
+					fmt.Sprintf("metric %s is also published by query %s", name, owner)))
+				continue
+			}
+			owners[name] = key
+		}
+	}
+
+	prefixes := sortedKeys(pivotPrefixes)
+	for _, prefix := range prefixes {
+		pivotKey := pivotPrefixes[prefix]
+		for _, other := range prefixes {
+			if other != prefix && strings.HasPrefix(other, prefix) {
+				lintErrors = append(lintErrors, lintNameError(queries[pivotPrefixes[other]], "",
+					fmt.Sprintf("pivot metrics %s* may also be published by pivot query %s", other, pivotKey)))
+			}
+		}
+		for _, name := range sortedKeys(owners) {
+			if owner := owners[name]; owner != pivotKey && strings.HasPrefix(name, prefix) {
+				lq := queries[owner]
+				lintErrors = append(lintErrors, lintNameError(lq, lintColumnOf(lq.query, name),
+					fmt.Sprintf("metric %s may also be published by pivot query %s", name, pivotKey)))
+			}
+		}
+	}
+	return lintErrors
+}
+
+// lintNameError locates a metric name problem at column if given, at query otherwise
+func lintNameError(lq *lintQuery, column, msg string) *LintError {
+	line := lq.lines.query(lq.key)
+	if column != "" {
+		line = lq.lines.column(lq.key, column, 0)
+	}
+	return &LintError{File: lq.file, Line: line, Query: lq.key, Msg: msg}
+}
+
+// lintColumnOf returns the column publishing a metric name, empty if not published by a column
+func lintColumnOf(q *QueryInstance, name string) string {
+	for _, colName := range q.MetricNames {
+		for _, published := range q.publishedNames(q.Columns[colName]) {
+			if published == name {
+				return colName
+			}
+		}
+	}
+	return ""
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// configLines locates queries, columns and versions in config content
+type configLines struct {
+	lines   []string
+	queries map[string]int // top level key -> line index
+}
+
+var topLevelKeyRegexp = regexp.MustCompile(`^["']?([^\s#"':][^"':]*)["']?\s*:`)
+
+func newConfigLines(content []byte) *configLines {
+	c := &configLines{lines: strings.Split(string(content), "\n"), queries: make(map[string]int)}
+	for i, line := range c.lines {
+		if m := topLevelKeyRegexp.FindStringSubmatch(line); m != nil {
+			c.queries[m[1]] = i
+		}
+	}
+	return c
+}
+
+// block returns line range [begin, end) of a top level key
+func (c *configLines) block(key string) (int, int) {
+	begin, ok := c.queries[key]
+	if !ok {
+		return 0, 0
+	}
+	end := len(c.lines)
+	for i := begin + 1; i < len(c.lines); i++ {
+		if topLevelKeyRegexp.MatchString(c.lines[i]) {
+			end = i
+			break
+		}
+	}
+	return begin, end
+}
+
+// query returns 1-based line of a top level key, 0 if not found
+func (c *configLines) query(key string) int {
+	if i, ok := c.queries[key]; ok {
+		return i + 1
+	}
+	return 0
+}
+
+// column returns 1-based line of n-th definition of a column in metrics of a query
+func (c *configLines) column(key, column string, n int) int {
+	begin, end := c.block(key)
+	nameRegexp := regexp.MustCompile(`^\s*(-\s+)?name:\s*["']?` + regexp.QuoteMeta(column) + `["']?\s*(#.*)?$`)
+	inMetrics := false
+	for i := begin; i < end; i++ {
+		if strings.HasPrefix(strings.TrimSpace(c.lines[i]), "metrics:") {
+			inMetrics = true
+		}
+		if inMetrics && nameRegexp.MatchString(c.lines[i]) {
+			if n == 0 {
+				return i + 1
+			}
+			n--
+		}
+	}
+	return c.query(key)
+}
+
+// version returns 1-based line of version of n-th query branch
+func (c *configLines) version(key string, n int) int {
+	begin, end := c.block(key)
+	for i := begin; i < end; i++ {
+		if strings.HasPrefix(strings.TrimLeft(strings.TrimSpace(c.lines[i]), "- "), "version:") {
+			if n == 0 {
+				return i + 1
+			}
+			n--
+		}
+	}
+	return c.query(key)
+}
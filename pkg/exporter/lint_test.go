@@ -0,0 +1,188 @@
+// Copyright © 2021 Bin Liu <bin.liu@enmotech.com>
+
+package exporter
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestLintConfig(t *testing.T) {
+	assert.Empty(t, LintConfig("../../og_exporter_default.yaml", nil))
+	assert.Empty(t, LintConfig("../../queries.yaml", nil))
+	assert.Len(t, LintConfig("../../not_exists.yaml", nil), 1)
+
+	dir, err := ioutil.TempDir("", "lint")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer os.RemoveAll(dir)
+	files := map[string]string{
+		"a.yaml": `q1:
+  name: q1
+  bogus: 1
+  query:
+    - sql: select 1
+      version: '>=1.0.0'
+    - sql: select 2
+      version: '>=1.2.0'
+  metrics:
+    - name: a
+      usage: LABEL
+    - name: a
+      usage: LABEL
+q2:
+  query:
+    - sql: select 1
+      version: 'abc'
+  metrics:
+    - name: x
+      usage: GAUGE
+`,
+		"b.yaml": `q3:
+  metric_prefix: q4
+  query:
+    - sql: select 1
+  metrics:
+    - name: c
+      usage: GAUGE
+q4:
+  query:
+    - sql: select 1
+  metrics:
+    - name: c
+      usage: WHAT
+`,
+		"c.yaml": "q5: [",
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(path.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Error(err)
+			return
+		}
+	}
+	var got []string
+	for _, err := range LintConfig(dir, nil) {
+		got = append(got, err.Error())
+	}
+	a, b, c := path.Join(dir, "a.yaml"), path.Join(dir, "b.yaml"), path.Join(dir, "c.yaml")
+	assert.Equal(t, []string{
+		a + ":3: field bogus not found in type exporter.QueryInstance",
+		a + `:8: q1: version range ">=1.2.0" overlaps with ">=1.0.0" (e.g. 1.2.0), only the first one is used`,
+		a + ":12: q1: column a is defined more than once",
+		a + `:17: q2: invalid version range "abc": Could not get version from string: "abc"`,
+		b + ":12: q4: column c have unsupported usage: WHAT",
+		c + ":1: did not find expected node content",
+	}, got)
+
+	// metric published twice
+	if err := ioutil.WriteFile(b, []byte(`q3:
+  metric_prefix: q4
+  query:
+    - sql: select 1
+  metrics:
+    - name: c
+      usage: GAUGE
+q4:
+  query:
+    - sql: select 1
+  metrics:
+    - name: c
+      usage: COUNTER
+`), 0644); err != nil {
+		t.Error(err)
+		return
+	}
+	lintErrors := LintConfig(b, nil)
+	if assert.Len(t, lintErrors, 1) {
+		assert.Equal(t, b+":12: q4: metric q4_c is also published by query q3", lintErrors[0].Error())
+	}
+
+	// every problem of a query is reported
+	if err := ioutil.WriteFile(b, []byte(`q3:
+  role: leader
+  query:
+    - sql: select 1
+  metrics:
+    - name: c
+      usage: WHAT
+    - name: d
+      usage: GAUGE
+      on_error: ignore
+    - name: e
+      usage: GAUGE
+`), 0644); err != nil {
+		t.Error(err)
+		return
+	}
+	got = got[:0]
+	for _, err := range LintConfig(b, nil) {
+		got = append(got, err.Error())
+	}
+	assert.Equal(t, []string{
+		b + ":1: q3: query q3 have unsupported role: leader",
+		b + ":6: q3: column c have unsupported usage: WHAT",
+		b + ":8: q3: column d have unsupported on_error: ignore",
+	}, got)
+}
+
+func TestLintConfig_metricNames(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lint")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer os.RemoveAll(dir)
+	file := path.Join(dir, "a.yaml")
+	if err := ioutil.WriteFile(file, []byte(`q1:
+  query:
+    - sql: select 1
+  metrics:
+    - name: commit
+      usage: DELTA
+      raw: true
+    - name: latency
+      usage: HISTOGRAM
+q2:
+  metric_prefix: q1
+  query:
+    - sql: select 1
+  metrics:
+    - name: commit
+      usage: COUNTER
+    - name: commit_delta
+      usage: GAUGE
+    - name: latency_count
+      usage: GAUGE
+q3:
+  metric_prefix: q1
+  key_column: name
+  value_column: value
+  query:
+    - sql: select 1
+  metrics:
+    - name: db
+      usage: LABEL
+`), 0644); err != nil {
+		t.Error(err)
+		return
+	}
+	var got []string
+	for _, err := range LintConfig(file, nil) {
+		got = append(got, err.Error())
+	}
+	assert.Equal(t, []string{
+		file + ":5: q1: metric q1_commit may also be published by pivot query q3",
+		file + ":5: q1: metric q1_commit_delta may also be published by pivot query q3",
+		file + ":8: q1: metric q1_latency_bucket may also be published by pivot query q3",
+		file + ":8: q1: metric q1_latency_count may also be published by pivot query q3",
+		file + ":8: q1: metric q1_latency_sum may also be published by pivot query q3",
+		file + ":15: q2: metric q1_commit is also published by query q1",
+		file + ":17: q2: metric q1_commit_delta is also published by query q1",
+		file + ":19: q2: metric q1_latency_count is also published by query q1",
+	}, got)
+}
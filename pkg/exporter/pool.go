@@ -0,0 +1,162 @@
+// Copyright © 2021 Bin Liu <bin.liu@enmotech.com>
+
+package exporter
+
+import (
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// dsn parameters of per target connection pool settings, which are not connection settings
+const (
+	dsnMaxOpenConnsKey    = "pool_max_open_conns"
+	dsnMaxIdleConnsKey    = "pool_max_idle_conns"
+	dsnConnMaxLifetimeKey = "pool_conn_max_lifetime"
+)
+
+// defaultQueryPriority is used by queries without priority, after user priorities 1 - 99
+// and before priorities assigned by config file rank
+const defaultQueryPriority = 100
+
+// poolConfig holds connection pool settings of a server. maxOpenConns is also the number
+// of queries executed at the same time during a scrape.
+type poolConfig struct {
+	maxOpenConns    int
+	maxIdleConns    int
+	connMaxLifetime time.Duration // 0 means connections are reused forever
+}
+
+func defaultPoolConfig() poolConfig {
+	return poolConfig{maxOpenConns: 1, maxIdleConns: 1}
+}
+
+// ServerWithPool configures connection pool of server, which could be overridden by dsn parameters
+// pool_max_open_conns, pool_max_idle_conns and pool_conn_max_lifetime
+func ServerWithPool(maxOpenConns, maxIdleConns int, connMaxLifetime time.Duration) ServerOpt {
+	return func(s *Server) {
+		s.pool = poolConfig{maxOpenConns: maxOpenConns, maxIdleConns: maxIdleConns, connMaxLifetime: connMaxLifetime}
+	}
+}
+
+// ServerWithScrapeBudget limits total execution time of queries during a scrape, 0 means unlimited.
+// Once exhausted, remaining queries serve their cached metrics if any, or are skipped.
+func ServerWithScrapeBudget(budget time.Duration) ServerOpt {
+	return func(s *Server) {
+		s.scrapeBudget = budget
+	}
+}
+
+// splitDSNPool extract connection pool settings from dsn into pool and returns the dsn without them
+func splitDSNPool(dsn string, pool *poolConfig) (string, error) {
+	if !strings.Contains(dsn, "pool_") {
+		return dsn, nil
+	}
+	settings, err := parseDsn(dsn)
+	if err != nil {
+		return "", err
+	}
+	found := false
+	for _, key := range []string{dsnMaxOpenConnsKey, dsnMaxIdleConnsKey} {
+		value, ok := settings[key]
+		if !ok {
+			continue
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return "", fmt.Errorf("invalid %s %q: %w", key, value, err)
+		}
+		if key == dsnMaxOpenConnsKey {
+			pool.maxOpenConns = n
+		} else {
+			pool.maxIdleConns = n
+		}
+		delete(settings, key)
+		found = true
+	}
+	if value, ok := settings[dsnConnMaxLifetimeKey]; ok {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return "", fmt.Errorf("invalid %s %q: %w", dsnConnMaxLifetimeKey, value, err)
+		}
+		pool.connMaxLifetime = d
+		delete(settings, dsnConnMaxLifetimeKey)
+		found = true
+	}
+	if !found {
+		return dsn, nil
+	}
+	return genDSNString(settings), nil
+}
+
+// applyPool applies pool settings to database connection
+func (s *Server) applyPool() {
+	if s.pool.maxOpenConns < 1 {
+		s.pool.maxOpenConns = 1
+	}
+	if s.pool.maxIdleConns < 0 {
+		s.pool.maxIdleConns = 0
+	}
+	s.db.SetMaxOpenConns(s.pool.maxOpenConns)
+	s.db.SetMaxIdleConns(s.pool.maxIdleConns)
+	s.db.SetConnMaxLifetime(s.pool.connMaxLifetime)
+}
+
+// PriorityValue returns priority of query instance, the lower runs first
+func (q *QueryInstance) PriorityValue() int {
+	if q.Priority <= 0 {
+		return defaultQueryPriority
+	}
+	return q.Priority
+}
+
+// sortedQueries returns names of query instances ordered by priority, then by name
+func sortedQueries(queryInstanceMap map[string]*QueryInstance) []string {
+	names := make([]string, 0, len(queryInstanceMap))
+	for name := range queryInstanceMap {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		pi, pj := queryInstanceMap[names[i]].PriorityValue(), queryInstanceMap[names[j]].PriorityValue()
+		if pi != pj {
+			return pi < pj
+		}
+		return names[i] < names[j]
+	})
+	return names
+}
+
+// forEachQuery calls fn for every name in order, with at most maxOpenConns calls running at the same time
+func (s *Server) forEachQuery(names []string, fn func(name string)) {
+	forEachLimit(len(names), s.pool.maxOpenConns, func(i int) {
+		fn(names[i])
+	})
+}
+
+// queryBudget tracks execution time of queries spent during a scrape
+type queryBudget struct {
+	limit   time.Duration // 0 means unlimited
+	used    int64         // nanoseconds, accessed atomically
+	skipped int64         // number of queries not executed due to exhausted budget, accessed atomically
+}
+
+func (b *queryBudget) exhausted() bool {
+	return b.limit > 0 && time.Duration(atomic.LoadInt64(&b.used)) >= b.limit
+}
+
+func (b *queryBudget) spend(d time.Duration) {
+	atomic.AddInt64(&b.used, int64(d))
+}
+
+func (b *queryBudget) skip() {
+	atomic.AddInt64(&b.skipped, 1)
+}
+
+func (s *Server) scrapeBudgetDesc() *prometheus.Desc {
+	return prometheus.NewDesc(prometheus.BuildFQName(s.namespace, "exporter", "scrape_budget_skipped_queries"),
+		"Number of queries not executed on the last scrape because the scrape budget was exhausted.", nil, s.labels)
+}
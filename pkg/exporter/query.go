@@ -7,11 +7,26 @@ import (
 	"github.com/blang/semver"
 	"github.com/prometheus/client_golang/prometheus"
 	"gopkg.in/yaml.v2"
+	"regexp"
+	"strconv"
 	"strings"
 	"time"
 )
 
+var (
+	metricNameRegexp  = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+	labelNameRegexp   = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+	placeholderRegexp = regexp.MustCompile(`\$(\d+)`)
+)
+
 const (
+	rolePrimary    = "primary"
+	roleStandby    = "standby"
+	roleAny        = "any"
+	scopeCluster   = "cluster"
+	scopeDatabase  = "database"
+	sortOrderAsc   = "asc"
+	sortOrderDesc  = "desc"
 	statusEnable   = "enable"
 	statusDisable  = "disable"
 	defaultVersion = ">=0.0.0"
@@ -31,30 +46,72 @@ func CheckStatus(s string) (string, error) {
 
 // QueryInstance hold the information of how to fetch metric and parse them
 type QueryInstance struct {
-	Name        string             `yaml:"name,omitempty"`     // actual query name, used as metric prefix
-	Desc        string             `yaml:"desc,omitempty"`     // description of this metric query
-	Queries     []*Query           `yaml:"query,omitempty"`    // 采集SQL
-	Metrics     []*Column          `yaml:"metrics,omitempty"`  // metric definition list
-	Status      string             `yaml:"status,omitempty"`   // enable/disable status. For the entire collection of indicators 针对整个采集指标
-	TTL         float64            `yaml:"ttl,omitempty"`      // caching ttl in seconds
-	Priority    int                `yaml:"priority,omitempty"` // 权重,暂时不用
-	Timeout     float64            `yaml:"timeout,omitempty"`  // query execution timeout in seconds
-	Path        string             `yaml:"-"`                  // where am I from ?
-	Columns     map[string]*Column `yaml:"-"`                  // column map
-	ColumnNames []string           `yaml:"-"`                  // column names in origin orders
-	LabelNames  []string           `yaml:"-"`                  // column (name) that used as label, sequences matters
-	MetricNames []string           `yaml:"-"`                  // column (name) that used as metric
+	Name             string             `yaml:"name,omitempty"`              // actual query name, used as metric prefix
+	MetricPrefix     string             `yaml:"metric_prefix,omitempty"`     // metric prefix instead of query name
+	Desc             string             `yaml:"desc,omitempty"`              // description of this metric query
+	Queries          []*Query           `yaml:"query,omitempty"`             // 采集SQL
+	Metrics          []*Column          `yaml:"metrics,omitempty"`           // metric definition list
+	Status           string             `yaml:"status,omitempty"`            // enable/disable status. For the entire collection of indicators 针对整个采集指标
+	TTL              float64            `yaml:"ttl,omitempty"`               // caching ttl in seconds
+	Interval         float64            `yaml:"interval,omitempty"`          // background collection interval in seconds, ttl if not set
+	Priority         int                `yaml:"priority,omitempty"`          // execution priority, the lower runs first
+	Timeout          float64            `yaml:"timeout,omitempty"`           // query execution timeout in seconds
+	Info             bool               `yaml:"info,omitempty"`              // emit a <prefix>_info series with value 1 carrying all label columns
+	KeyColumn        string             `yaml:"key_column,omitempty"`        // pivot mode: column holding the metric name of each row
+	ValueColumn      string             `yaml:"value_column,omitempty"`      // pivot mode: column holding the metric value of each row
+	MaxSeries        int                `yaml:"max_series,omitempty"`        // max series emitted per execution, 0 means unlimited
+	SortColumn       string             `yaml:"sort_column,omitempty"`       // sort rows by this column before truncating to max_series
+	SortOrder        string             `yaml:"sort_order,omitempty"`        // asc or desc (default)
+	Role             string             `yaml:"role,omitempty"`              // run on primary, standby or any (default) server
+	Predicate        string             `yaml:"predicate,omitempty"`         // sql returning a single boolean, query runs only if it is true
+	Scope            string             `yaml:"scope,omitempty"`             // cluster: run once per instance, database (default): run on every database
+	IncludeDatabases []string           `yaml:"include_databases,omitempty"` // run only on these databases if given
+	ExcludeDatabases []string           `yaml:"exclude_databases,omitempty"` // never run on these databases
+	Path             string             `yaml:"-"`                           // where am I from ?
+	Columns          map[string]*Column `yaml:"-"`                           // column map
+	ColumnNames      []string           `yaml:"-"`                           // column names in origin orders
+	LabelNames       []string           `yaml:"-"`                           // column (name) that used as label, sequences matters
+	LabelKeys        []string           `yaml:"-"`                           // published label names (after rename), same order as LabelNames
+	MetricNames      []string           `yaml:"-"`                           // column (name) that used as metric
 }
 
 type Query struct {
-	Name              string       `yaml:"name,omitempty"`    // actual query name, used as metric prefix
-	SQL               string       `yaml:"sql,omitempty"`     // actual query sql 查询sql
-	SupportedVersions string       `yaml:"version,omitempty"` // Check supported version 查询支持版本
-	versionRange      semver.Range `yaml:"-"`                 // semver.Range
-	Tags              []string     `yaml:"tags,omitempty"`    // tags are used for execution control
-	Timeout           float64      `yaml:"timeout,omitempty"` // query execution timeout in seconds
-	TTL               float64      `yaml:"ttl,omitempty"`     // caching ttl in seconds
-	Status            string       `yaml:"status,omitempty"`  // enable/disable status. 状态是否开启,针对特定版本.
+	Name              string       `yaml:"name,omitempty"`     // actual query name, used as metric prefix
+	SQL               string       `yaml:"sql,omitempty"`      // actual query sql 查询sql
+	SQLFile           string       `yaml:"sql_file,omitempty"` // read sql from this file, relative to the config file
+	SupportedVersions string       `yaml:"version,omitempty"`  // Check supported version 查询支持版本
+	versionRange      semver.Range `yaml:"-"`                  // semver.Range
+	Tags              []string     `yaml:"tags,omitempty"`     // tags are used for execution control
+	Timeout           float64      `yaml:"timeout,omitempty"`  // query execution timeout in seconds
+	TTL               float64      `yaml:"ttl,omitempty"`      // caching ttl in seconds
+	Status            string       `yaml:"status,omitempty"`   // enable/disable status. 状态是否开启,针对特定版本.
+	Params            []string     `yaml:"params,omitempty"`   // bind parameters of sql, passed as $1..$n
+}
+
+// Args returns bind parameters of sql
+func (q *Query) Args() []interface{} {
+	args := make([]interface{}, len(q.Params))
+	for i, param := range q.Params {
+		args[i] = param
+	}
+	return args
+}
+
+// checkParams checks that every $n placeholder in sql has a bind parameter
+func (q *Query) checkParams() error {
+	if len(q.Params) == 0 {
+		return nil
+	}
+	var max int
+	for _, m := range placeholderRegexp.FindAllStringSubmatch(q.SQL, -1) {
+		if n, _ := strconv.Atoi(m[1]); n > max {
+			max = n
+		}
+	}
+	if max != len(q.Params) {
+		return fmt.Errorf("query %s uses %d placeholders but has %d params", q.Name, max, len(q.Params))
+	}
+	return nil
 }
 
 // TimeoutDuration Get timeout settings
@@ -62,6 +119,33 @@ func (q *Query) TimeoutDuration() time.Duration {
 	return time.Duration(float64(time.Second) * q.Timeout)
 }
 
+// MatchTags reports whether this query should run on a server with given tags
+func (q *Query) MatchTags(serverTags []string) bool {
+	return MatchTags(q.Tags, serverTags)
+}
+
+// MatchRole reports whether this query should run on a server with given
+// replication role. Unknown role matches every query.
+func (q *QueryInstance) MatchRole(role string) bool {
+	return role == "" || q.Role == "" || q.Role == roleAny || q.Role == role
+}
+
+// MatchScope reports whether this query should run on a database. Cluster
+// scope queries run only on master server, so they are collected once per
+// instance under auto discovery. Unknown database skips include/exclude lists.
+func (q *QueryInstance) MatchScope(master bool, database string) bool {
+	if q.Scope == scopeCluster && !master {
+		return false
+	}
+	if database == "" {
+		return true
+	}
+	if len(q.IncludeDatabases) > 0 && !Contains(q.IncludeDatabases, database) {
+		return false
+	}
+	return !Contains(q.ExcludeDatabases, database)
+}
+
 // TimeoutDuration Get timeout settings
 func (q *QueryInstance) TimeoutDuration() time.Duration {
 	return time.Duration(float64(time.Second) * q.Timeout)
@@ -77,6 +161,16 @@ func (q *QueryInstance) ToYaml() string {
 
 // Check configuration and handle default values 检查配置并处理默认值
 func (q *QueryInstance) Check() error {
+	if errs := q.check(); len(errs) > 0 {
+		return errs[0]
+	}
+	return nil
+}
+
+// check handles default values and returns all problems found in configuration, so that
+// a linter could report them at once. A query with any problem must not be used.
+func (q *QueryInstance) check() []error {
+	var errs []error
 	if q.Timeout == 0 {
 		q.Timeout = 0.1
 	}
@@ -87,7 +181,7 @@ func (q *QueryInstance) Check() error {
 		q.TTL = 60
 	}
 	if status, err := CheckStatus(q.Status); err != nil {
-		return err
+		errs = append(errs, err)
 	} else {
 		q.Status = status
 	}
@@ -101,48 +195,163 @@ func (q *QueryInstance) Check() error {
 		if query.SupportedVersions == "" {
 			query.SupportedVersions = defaultVersion
 		}
-		query.versionRange = semver.MustParseRange(query.SupportedVersions)
+		versionRange, err := semver.ParseRange(query.SupportedVersions)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("query %s have invalid version range %q: %w", q.Name, query.SupportedVersions, err))
+		}
+		query.versionRange = versionRange
 		if status, err := CheckStatus(query.Status); err != nil {
-			return err
+			errs = append(errs, err)
 		} else {
 			query.Status = status
 		}
+		if err := checkTags(query.Tags); err != nil {
+			errs = append(errs, fmt.Errorf("query %s: %w", q.Name, err))
+		}
 		if query.TTL == 0 {
 			query.TTL = q.TTL
 		}
 		query.Name = q.Name
+		if query.SQL != "" { // sql_file is checked once loaded
+			if err := query.checkParams(); err != nil {
+				errs = append(errs, err)
+			}
+		}
 	}
 
-	var allColumns, labelColumns, metricColumns []string
+	q.Predicate = strings.TrimSpace(q.Predicate)
 
-	for _, column := range q.Metrics {
+	switch q.Scope = strings.ToLower(q.Scope); q.Scope {
+	case "":
+		q.Scope = scopeDatabase
+	case scopeCluster, scopeDatabase:
+	default:
+		errs = append(errs, fmt.Errorf("query %s have unsupported scope: %s", q.Name, q.Scope))
+	}
+	for _, name := range q.IncludeDatabases {
+		if Contains(q.ExcludeDatabases, name) {
+			errs = append(errs, fmt.Errorf("query %s: database %s is both included and excluded", q.Name, name))
+		}
+	}
+
+	switch q.Role = strings.ToLower(q.Role); q.Role {
+	case "":
+		q.Role = roleAny
+	case rolePrimary, roleStandby, roleAny:
+	default:
+		errs = append(errs, fmt.Errorf("query %s have unsupported role: %s", q.Name, q.Role))
+	}
+	if q.MaxSeries < 0 {
+		errs = append(errs, fmt.Errorf("query %s have negative max_series: %d", q.Name, q.MaxSeries))
+	}
+	switch q.SortOrder = strings.ToLower(q.SortOrder); q.SortOrder {
+	case "":
+		q.SortOrder = sortOrderDesc
+	case sortOrderAsc, sortOrderDesc:
+	default:
+		errs = append(errs, fmt.Errorf("query %s have unsupported sort_order: %s", q.Name, q.SortOrder))
+	}
+	if q.MetricPrefix != "" && !metricNameRegexp.MatchString(q.MetricPrefix) {
+		errs = append(errs, fmt.Errorf("query %s have invalid metric_prefix: %s", q.Name, q.MetricPrefix))
+	}
+
+	var allColumns, labelColumns, labelKeys, metricColumns []string
+	publishNames := make(map[string]string, len(q.Metrics))
+	declared := make(map[string]string, len(q.Metrics))
 
-		if _, isValid := ColumnUsage[column.Usage]; !isValid {
-			return fmt.Errorf("column %s have unsupported usage: %s", column.Name, column.Desc)
+	for _, column := range q.Metrics {
+		if err := q.checkColumn(column, declared, publishNames); err != nil {
+			errs = append(errs, err)
+			continue
 		}
-		column.Usage = strings.ToUpper(column.Usage)
 		switch column.Usage {
 		case LABEL:
 			labelColumns = append(labelColumns, column.Name)
+			labelKeys = append(labelKeys, column.PublishName())
 			column.DisCard = true
 		case DISCARD:
 			column.DisCard = true
-		case GAUGE:
-			metricColumns = append(metricColumns, column.Name)
-		case COUNTER:
-			metricColumns = append(metricColumns, column.Name)
 		case HISTOGRAM:
 			column.Histogram = true
 			metricColumns = append(metricColumns, column.Name)
-		case MappedMETRIC:
-			metricColumns = append(metricColumns, column.Name)
-		case DURATION:
+			// bucket, sum and count columns are consumed by the histogram column itself
+			for _, suffix := range []string{histogramBucketSuffix, histogramSumSuffix, histogramCountSuffix} {
+				if _, ok := columns[column.Name+suffix]; !ok {
+					columns[column.Name+suffix] = &Column{Name: column.Name + suffix, Usage: DISCARD, DisCard: true}
+				}
+			}
+		default:
 			metricColumns = append(metricColumns, column.Name)
 		}
 		allColumns = append(allColumns, column.Name)
 		columns[column.Name] = column
 	}
-	q.Columns, q.ColumnNames, q.LabelNames, q.MetricNames = columns, allColumns, labelColumns, metricColumns
+	if q.Info && len(labelColumns) == 0 {
+		errs = append(errs, fmt.Errorf("info query %s requires at least one LABEL column", q.Name))
+	}
+	q.Columns, q.ColumnNames, q.LabelNames, q.LabelKeys, q.MetricNames = columns, allColumns, labelColumns, labelKeys, metricColumns
+	if q.KeyColumn != "" || q.ValueColumn != "" {
+		if err := q.checkPivot(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+// checkColumn validates a column and handles its default values. declared and publishNames
+// hold usage and published name of columns checked before.
+func (q *QueryInstance) checkColumn(column *Column, declared, publishNames map[string]string) error {
+	if _, isValid := ColumnUsage[column.Usage]; !isValid {
+		return fmt.Errorf("column %s have unsupported usage: %s", column.Name, column.Usage)
+	}
+	column.Usage = strings.ToUpper(column.Usage)
+	if usage, ok := declared[column.Name]; ok && (usage == LABEL) != (column.Usage == LABEL) {
+		return fmt.Errorf("column %s is used as both label and metric", column.Name)
+	}
+	declared[column.Name] = column.Usage
+	if column.Usage == DURATION && column.Unit == "" {
+		column.Unit = "ms"
+	}
+	if column.Unit != "" {
+		if _, ok := unitConversions[column.Unit]; !ok {
+			return fmt.Errorf("column %s have unsupported unit: %s", column.Name, column.Unit)
+		}
+		if column.Usage != GAUGE && column.Usage != COUNTER && column.Usage != DURATION && column.Usage != DELTA && column.Usage != RATE {
+			return fmt.Errorf("column %s with usage %s does not support unit", column.Name, column.Usage)
+		}
+	}
+	if err := column.checkPolicy(); err != nil {
+		return err
+	}
+	if column.LagFrom != "" && column.Usage != LSN {
+		return fmt.Errorf("column %s with usage %s does not support lag_from", column.Name, column.Usage)
+	}
+	if column.Rename != "" && !labelNameRegexp.MatchString(column.Rename) {
+		return fmt.Errorf("column %s have invalid rename: %s", column.Name, column.Rename)
+	}
+	if column.Usage != DISCARD {
+		if other, ok := publishNames[column.PublishName()]; ok && other != column.Name {
+			return fmt.Errorf("column %s and %s are both published as %s", other, column.Name, column.PublishName())
+		}
+		publishNames[column.PublishName()] = column.Name
+	}
+	switch column.Usage {
+	case MappedMETRIC:
+		if len(column.Mapping) == 0 {
+			return fmt.Errorf("column %s with usage %s requires a mapping", column.Name, column.Usage)
+		}
+	case STATESET:
+		if len(column.States) == 0 {
+			return fmt.Errorf("column %s with usage %s requires states", column.Name, column.Usage)
+		}
+		seen := make(map[string]bool, len(column.States))
+		for _, state := range column.States {
+			if seen[strings.ToLower(state)] {
+				return fmt.Errorf("column %s have duplicate state: %s", column.Name, state)
+			}
+			seen[strings.ToLower(state)] = true
+		}
+	}
 	return nil
 }
 
@@ -160,29 +369,129 @@ func (q *QueryInstance) GetQuerySQL(ver semver.Version) *Query {
 }
 
 // GetColumn Get column information
-func (q *QueryInstance) GetColumn(colName string, serverLabels prometheus.Labels) *Column {
-	if col, ok := q.Columns[colName]; ok {
-		switch col.Usage {
-		case LABEL, DISCARD:
-			col.DisCard = true
-		case GAUGE:
-			col.PrometheusType = prometheus.GaugeValue
-			col.PrometheusDesc = prometheus.NewDesc(fmt.Sprintf("%s_%s", q.Name, col.Name), col.Desc, q.LabelNames, serverLabels)
-		case COUNTER:
-			col.PrometheusType = prometheus.CounterValue
-			col.PrometheusDesc = prometheus.NewDesc(fmt.Sprintf("%s_%s", q.Name, col.Name), col.Desc, q.LabelNames, serverLabels)
-		case HISTOGRAM:
-			col.PrometheusType = prometheus.UntypedValue
-			col.PrometheusDesc = prometheus.NewDesc(fmt.Sprintf("%s_%s", q.Name, col.Name), col.Desc, q.LabelNames, serverLabels)
-		case MappedMETRIC:
-			col.PrometheusType = prometheus.GaugeValue
-			col.PrometheusDesc = prometheus.NewDesc(fmt.Sprintf("%s_%s", q.Name, col.Name), col.Desc, q.LabelNames, serverLabels)
-		case DURATION:
-			col.PrometheusType = prometheus.GaugeValue
-			col.PrometheusDesc = prometheus.NewDesc(fmt.Sprintf("%s_%s_milliseconds", q.Name, col.Name), col.Desc, q.LabelNames, serverLabels)
+func (q *QueryInstance) GetColumn(colName string) *Column {
+	return q.Columns[colName]
+}
+
+// columnDesc descriptors of a metric column for one server
+type columnDesc struct {
+	desc      *prometheus.Desc
+	rawDesc   *prometheus.Desc // DELTA/RATE: description of the raw counter
+	valueType prometheus.ValueType
+}
+
+// newColumnDesc build descriptors of a metric column with the const labels of a server.
+// Query instances are shared by all servers, so nothing is stored on the column.
+func (q *QueryInstance) newColumnDesc(col *Column, serverLabels prometheus.Labels) *columnDesc {
+	d := &columnDesc{valueType: prometheus.GaugeValue}
+	labelKeys := q.LabelKeys
+	switch col.Usage {
+	case COUNTER:
+		d.valueType = prometheus.CounterValue
+	case HISTOGRAM:
+		d.valueType = prometheus.UntypedValue
+	case STATESET:
+		// state label is named after the metric, as OpenMetrics stateset does
+		labelKeys = append(append(make([]string, 0, len(q.LabelKeys)+1), q.LabelKeys...), col.PublishName())
+	case DELTA, RATE:
+		d.desc = prometheus.NewDesc(q.derivedMetricName(col), col.Desc, labelKeys, serverLabels)
+		if col.Raw {
+			d.rawDesc = prometheus.NewDesc(q.metricName(col), col.Desc, labelKeys, serverLabels)
 		}
+		return d
+	}
+	d.desc = prometheus.NewDesc(q.metricName(col), col.Desc, labelKeys, serverLabels)
+	return d
+}
 
-		return col
+// checkPivot validate key/value pivot columns. The key column is discarded,
+// the value column defaults to a GAUGE and is not emitted as a metric itself.
+func (q *QueryInstance) checkPivot() error {
+	columns := q.Columns
+	if q.KeyColumn == "" || q.ValueColumn == "" {
+		return fmt.Errorf("query %s requires both key_column and value_column", q.Name)
+	}
+	if q.KeyColumn == q.ValueColumn {
+		return fmt.Errorf("query %s key_column and value_column must differ", q.Name)
+	}
+	if col, ok := columns[q.KeyColumn]; !ok {
+		columns[q.KeyColumn] = &Column{Name: q.KeyColumn, Usage: DISCARD, DisCard: true}
+	} else if col.Usage != DISCARD {
+		return fmt.Errorf("query %s key_column %s must have usage %s", q.Name, q.KeyColumn, DISCARD)
+	}
+	col, ok := columns[q.ValueColumn]
+	if !ok {
+		col = &Column{Name: q.ValueColumn, Usage: GAUGE}
+		columns[q.ValueColumn] = col
+	}
+	if col.Usage != GAUGE && col.Usage != COUNTER {
+		return fmt.Errorf("query %s value_column %s must have usage %s or %s", q.Name, q.ValueColumn, GAUGE, COUNTER)
+	}
+	for i, name := range q.MetricNames {
+		if name == q.ValueColumn {
+			q.MetricNames = append(q.MetricNames[:i], q.MetricNames[i+1:]...)
+			break
+		}
 	}
 	return nil
 }
+
+// PivotDesc Get description of a metric whose name comes from the key column
+func (q *QueryInstance) PivotDesc(key string, serverLabels prometheus.Labels) *prometheus.Desc {
+	col := q.Columns[q.ValueColumn]
+	desc := col.Desc
+	if desc == "" {
+		desc = fmt.Sprintf("%s of %s by %s", q.ValueColumn, q.Name, q.KeyColumn)
+	}
+	name := fmt.Sprintf("%s_%s", q.Prefix(), sanitizeMetricName(key))
+	if col.Unit != "" && !strings.HasSuffix(name, "_"+unitConversions[col.Unit].base) {
+		name += "_" + unitConversions[col.Unit].base
+	}
+	return prometheus.NewDesc(name, desc, q.LabelKeys, serverLabels)
+}
+
+// InfoDesc Get description of the <prefix>_info series of an info query
+func (q *QueryInstance) InfoDesc(serverLabels prometheus.Labels) *prometheus.Desc {
+	desc := q.Desc
+	if desc == "" {
+		desc = fmt.Sprintf("Information about %s", q.Name)
+	}
+	return prometheus.NewDesc(fmt.Sprintf("%s_info", q.Prefix()), desc, q.LabelKeys, serverLabels)
+}
+
+// Prefix Get metric prefix, metric_prefix if given, query name otherwise
+func (q *QueryInstance) Prefix() string {
+	if q.MetricPrefix != "" {
+		return q.MetricPrefix
+	}
+	return q.Name
+}
+
+// metricName Get metric name of a column, with base unit suffix if column has unit
+func (q *QueryInstance) metricName(col *Column) string {
+	return fmt.Sprintf("%s_%s%s", q.Prefix(), col.PublishName(), col.metricSuffix())
+}
+
+// derivedMetricName Get metric name of the increase or rate of a DELTA or RATE column
+func (q *QueryInstance) derivedMetricName(col *Column) string {
+	return fmt.Sprintf("%s_%s", q.metricName(col), strings.ToLower(col.Usage))
+}
+
+// publishedNames returns metric names exposed for a column, including the raw metric of
+// DELTA and RATE columns and the series of a histogram. Names of pivot metrics depend on
+// rows and are not included.
+func (q *QueryInstance) publishedNames(col *Column) []string {
+	switch col.Usage {
+	case LABEL, DISCARD:
+		return nil
+	case HISTOGRAM:
+		name := q.metricName(col)
+		return []string{name + histogramBucketSuffix, name + histogramSumSuffix, name + histogramCountSuffix}
+	case DELTA, RATE:
+		if col.Raw {
+			return []string{q.derivedMetricName(col), q.metricName(col)}
+		}
+		return []string{q.derivedMetricName(col)}
+	}
+	return []string{q.metricName(col)}
+}
@@ -119,6 +119,16 @@ func TestQueryInstance(t *testing.T) {
 		assert.Error(t, err)
 		queryInstance.Metrics[0].Usage = LABEL
 	})
+	t.Run("Check_Metric_Mapping_err", func(t *testing.T) {
+		queryInstance.Metrics[2].Usage = MappedMETRIC
+		err := queryInstance.Check()
+		assert.Error(t, err)
+		queryInstance.Metrics[2].Mapping = map[string]float64{"on": 1, "off": 0}
+		err = queryInstance.Check()
+		assert.NoError(t, err)
+		queryInstance.Metrics[2].Usage = GAUGE
+		queryInstance.Metrics[2].Mapping = nil
+	})
 	t.Run("Check", func(t *testing.T) {
 		err := queryInstance.Check()
 		assert.NoError(t, err)
@@ -143,15 +153,15 @@ func TestQueryInstance(t *testing.T) {
 		assert.NotNil(t, q)
 	})
 	t.Run("GetColumn", func(t *testing.T) {
-		c := queryInstance.GetColumn("col1", nil)
+		c := queryInstance.GetColumn("col1")
 		assert.NotNil(t, c)
-		col2 := queryInstance.GetColumn("col2", nil)
+		col2 := queryInstance.GetColumn("col2")
 		assert.NotNil(t, col2)
-		col3 := queryInstance.GetColumn("col3", nil)
+		col3 := queryInstance.GetColumn("col3")
 		assert.NotNil(t, col3)
-		col4 := queryInstance.GetColumn("col4", nil)
+		col4 := queryInstance.GetColumn("col4")
 		assert.NotNil(t, col4)
-		col5 := queryInstance.GetColumn("col5", nil)
+		col5 := queryInstance.GetColumn("col5")
 		assert.Nil(t, col5)
 	})
 }
@@ -162,3 +172,71 @@ func TestQuery(t *testing.T) {
 		assert.Equal(t, time.Duration(float64(time.Second)*query.Timeout), r)
 	})
 }
+
+func TestQueryInstance_MatchRole(t *testing.T) {
+	q := &QueryInstance{Name: "pg_stat_replication", Role: "Primary", Queries: []*Query{{SQL: "select 1"}}}
+	assert.NoError(t, q.Check())
+	assert.Equal(t, rolePrimary, q.Role)
+	assert.True(t, q.MatchRole(rolePrimary))
+	assert.False(t, q.MatchRole(roleStandby))
+	assert.True(t, q.MatchRole(""))
+
+	q = &QueryInstance{Name: "pg_lock", Queries: []*Query{{SQL: "select 1"}}}
+	assert.NoError(t, q.Check())
+	assert.Equal(t, roleAny, q.Role)
+	assert.True(t, q.MatchRole(roleStandby))
+
+	q = &QueryInstance{Name: "pg_lock", Role: "replica", Queries: []*Query{{SQL: "select 1"}}}
+	assert.Error(t, q.Check())
+}
+
+func TestQueryInstance_MatchScope(t *testing.T) {
+	q := &QueryInstance{Name: "pg_lock", Scope: "Cluster", Queries: []*Query{{SQL: "select 1"}}}
+	assert.NoError(t, q.Check())
+	assert.Equal(t, scopeCluster, q.Scope)
+	assert.True(t, q.MatchScope(true, "postgres"))
+	assert.False(t, q.MatchScope(false, "app"))
+
+	q = &QueryInstance{Name: "og_tables_size", ExcludeDatabases: []string{"postgres"}, Queries: []*Query{{SQL: "select 1"}}}
+	assert.NoError(t, q.Check())
+	assert.Equal(t, scopeDatabase, q.Scope)
+	assert.True(t, q.MatchScope(false, "app"))
+	assert.False(t, q.MatchScope(true, "postgres"))
+	assert.True(t, q.MatchScope(true, ""))
+
+	q = &QueryInstance{Name: "og_tables_size", IncludeDatabases: []string{"app"}, Queries: []*Query{{SQL: "select 1"}}}
+	assert.NoError(t, q.Check())
+	assert.True(t, q.MatchScope(false, "app"))
+	assert.False(t, q.MatchScope(false, "other"))
+
+	q.ExcludeDatabases = []string{"app"}
+	assert.Error(t, q.Check())
+	q = &QueryInstance{Name: "pg_lock", Scope: "instance", Queries: []*Query{{SQL: "select 1"}}}
+	assert.Error(t, q.Check())
+}
+
+func TestQueryInstance_Check_version(t *testing.T) {
+	q := &QueryInstance{Name: "pg_lock", Queries: []*Query{{SQL: "select 1", SupportedVersions: "abc"}}}
+	assert.Error(t, q.Check())
+
+	q = &QueryInstance{Name: "pg_lock", Queries: []*Query{{SQL: "select 1"}}, Metrics: []*Column{
+		{Name: "datname", Usage: LABEL},
+		{Name: "datname", Usage: GAUGE},
+	}}
+	assert.EqualError(t, q.Check(), "column datname is used as both label and metric")
+}
+
+func TestQuery_checkParams(t *testing.T) {
+	q := &QueryInstance{Name: "og_need_indexes", Queries: []*Query{
+		{SQL: "select relname from pg_stat_user_tables where pg_table_size(relid) > $1 limit $2", Params: []string{"1024", "10"}},
+	}}
+	assert.NoError(t, q.Check())
+	assert.Equal(t, []interface{}{"1024", "10"}, q.Queries[0].Args())
+
+	q.Queries[0].Params = []string{"1024"}
+	assert.EqualError(t, q.Check(), "query og_need_indexes uses 2 placeholders but has 1 params")
+
+	q = &QueryInstance{Name: "pg_lock", Queries: []*Query{{SQL: "select 1"}}}
+	assert.NoError(t, q.Check())
+	assert.Empty(t, q.Queries[0].Args())
+}
@@ -0,0 +1,269 @@
+// Copyright © 2021 Bin Liu <bin.liu@enmotech.com>
+
+package exporter
+
+import (
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+	"math/rand"
+	"time"
+)
+
+// schedulerTick is how often scheduler looks for queries due to run
+var schedulerTick = time.Second
+
+// refreshInterval is how often scheduler refreshes version, replication role and settings of a server,
+// and targets of background collection are discovered again
+var refreshInterval = 15 * time.Second
+
+// ServerWithBackground runs queries by a scheduler in background instead of during scrapes
+func ServerWithBackground(b bool) ServerOpt {
+	return func(s *Server) {
+		s.background = b
+	}
+}
+
+// CollectInterval returns interval of background collection, ttl if interval is not set
+func (q *QueryInstance) CollectInterval() time.Duration {
+	interval := q.Interval
+	if interval <= 0 {
+		interval = q.TTL
+	}
+	if interval < 1 {
+		interval = 1
+	}
+	return time.Duration(interval * float64(time.Second))
+}
+
+// collectJitter returns a random delay up to 10% of interval, so that queries do not run at the same time
+func collectJitter(interval time.Duration) time.Duration {
+	return time.Duration(rand.Int63n(int64(interval)/10 + 1))
+}
+
+// startScheduler starts background collection once, it stops when server is closed
+func (s *Server) startScheduler() {
+	s.schedulerOnce.Do(func() {
+		s.done = make(chan struct{})
+		log.Infof("Starting background collection on %s", s)
+		go s.schedule(s.done)
+	})
+}
+
+func (s *Server) stopScheduler() {
+	s.stopOnce.Do(func() {
+		if s.done != nil {
+			close(s.done)
+		}
+	})
+}
+
+func (s *Server) schedule(done <-chan struct{}) {
+	nextRun := make(map[string]time.Time)
+	var lastRefresh time.Time
+	ticker := time.NewTicker(schedulerTick)
+	defer ticker.Stop()
+	for {
+		if now := time.Now(); now.Sub(lastRefresh) >= refreshInterval {
+			s.refresh()
+			lastRefresh = now
+		}
+		s.collectDue(time.Now(), nextRun)
+		select {
+		case <-done:
+			log.Infof("Background collection on %s stopped", s)
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// refresh checks connection, then updates version, replication role and settings of server, so that
+// scrapes serve them without querying database. Metrics of the previous refresh are kept on connection error.
+func (s *Server) refresh() {
+	if err := s.db.Ping(); err != nil {
+		log.Errorf("Error connecting to %q: %v", s, err)
+		s.statusMtx.Lock()
+		s.connErr = err
+		s.statusMtx.Unlock()
+		return
+	}
+	metrics := gatherMetrics(func(ch chan<- prometheus.Metric) {
+		if err := s.checkVersion(ch); err != nil {
+			log.Warnln("Proceeding with outdated query maps, as the OpenGauss version could not be determined:", err)
+		}
+		if err := s.QueryRole(); err != nil {
+			log.Warnln("Proceeding with queries of any role, as the replication role could not be determined:", err)
+		}
+		if !s.disableSettingsMetrics && s.isMaster() {
+			if err := s.querySettings(ch); err != nil {
+				log.Errorf("error retrieving settings on %q: %s", s, err)
+			}
+		}
+	})
+	s.statusMtx.Lock()
+	s.statusMetrics, s.connErr = metrics, nil
+	s.statusMtx.Unlock()
+}
+
+// statusSnapshot returns version and settings metrics of the last refresh
+func (s *Server) statusSnapshot() []prometheus.Metric {
+	s.statusMtx.Lock()
+	defer s.statusMtx.Unlock()
+	return s.statusMetrics
+}
+
+// connError returns connection error of the last refresh, nil if connected
+func (s *Server) connError() error {
+	s.statusMtx.Lock()
+	defer s.statusMtx.Unlock()
+	return s.connErr
+}
+
+// gatherMetrics returns all metrics sent by fn
+func gatherMetrics(fn func(ch chan<- prometheus.Metric)) []prometheus.Metric {
+	var metrics []prometheus.Metric
+	ch := make(chan prometheus.Metric)
+	done := make(chan struct{})
+	go func() {
+		for m := range ch {
+			metrics = append(metrics, m)
+		}
+		close(done)
+	}()
+	fn(ch)
+	close(ch)
+	<-done
+	return metrics
+}
+
+// collectDue runs queries whose next run is before now in order of priority, and stores results in metric cache
+func (s *Server) collectDue(now time.Time, nextRun map[string]time.Time) {
+	due, queryInstances := s.dueQueries(now, nextRun)
+	s.forEachQuery(due, func(metric string) {
+		start := time.Now()
+		s.cacheMetric(metric, s.runMetric(metric, queryInstances[metric], start))
+		log.Debugf("Background collection of %s on %s took %s", metric, s, time.Since(start))
+	})
+}
+
+// dueQueries returns queries whose next run is before now and schedules their next run.
+// Query instances are copied under mappingMtx, which is released before they run,
+// so that writers waiting on it do not block scrapes for the duration of the queries.
+func (s *Server) dueQueries(now time.Time, nextRun map[string]time.Time) ([]string, map[string]*QueryInstance) {
+	s.mappingMtx.RLock()
+	defer s.mappingMtx.RUnlock()
+	var due []string
+	queryInstances := make(map[string]*QueryInstance)
+	for _, metric := range sortedQueries(s.queryInstanceMap) {
+		queryInstance := s.queryInstanceMap[metric]
+		next, ok := nextRun[metric]
+		if !ok { // spread first runs of queries within 10s at most
+			interval := queryInstance.CollectInterval()
+			if interval > 100*time.Second {
+				interval = 100 * time.Second
+			}
+			next = now.Add(collectJitter(interval))
+			nextRun[metric] = next
+		}
+		if now.Before(next) {
+			continue
+		}
+		interval := queryInstance.CollectInterval()
+		nextRun[metric] = now.Add(interval + collectJitter(interval))
+		if s.matchQuery(metric, queryInstance) {
+			due = append(due, metric)
+			queryInstances[metric] = queryInstance
+		}
+	}
+	for metric := range nextRun {
+		if _, ok := s.queryInstanceMap[metric]; !ok {
+			delete(nextRun, metric)
+		}
+	}
+	return due, queryInstances
+}
+
+func (s *Server) snapshotAgeDesc() *prometheus.Desc {
+	return prometheus.NewDesc(prometheus.BuildFQName(s.namespace, "exporter", "query_snapshot_age_seconds"),
+		"Seconds since the snapshot of a query served from background collection was taken.", []string{"query"}, s.labels)
+}
+
+// startBackground starts schedulers of all targets, then discovers targets again every refreshInterval,
+// so that schedulers of new databases are started and those of databases no longer discovered are stopped
+func (e *Exporter) startBackground() {
+	e.syncSchedulers()
+	go func() {
+		ticker := time.NewTicker(refreshInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-e.done:
+				return
+			case <-ticker.C:
+				e.syncSchedulers()
+			}
+		}
+	}()
+}
+
+// syncSchedulers starts scheduler of every target and stops the others. Targets of a dsn whose databases
+// could not be discovered are kept from the previous discovery.
+func (e *Exporter) syncSchedulers() {
+	targets := make([][]string, len(e.dsn))
+	if e.autoDiscovery {
+		targets = e.discoverDatabases()
+	}
+	e.targetsMtx.Lock()
+	for i, dsn := range e.dsn {
+		switch {
+		case !e.autoDiscovery:
+			targets[i] = []string{dsn}
+		case targets[i] == nil && i < len(e.targets):
+			targets[i] = e.targets[i]
+		}
+	}
+	e.targets = targets
+	e.targetsMtx.Unlock()
+
+	keep := append([]string{}, e.dsn...) // dsn used for discovery
+	for _, dsnList := range targets {
+		for _, dsn := range dsnList {
+			server, err := e.servers.server(dsn)
+			if err != nil {
+				log.Errorf("Error opening connection to database (%s): %v", ShadowDSN(dsn), err)
+				continue
+			}
+			if !e.autoDiscovery {
+				server.setMaster()
+			}
+			server.initQueryInstanceMap(e.GetMetricsList())
+			server.startScheduler()
+			keep = append(keep, dsn)
+		}
+	}
+	e.servers.retain(keep)
+}
+
+// backgroundTargets returns dsn of all scheduled targets
+func (e *Exporter) backgroundTargets() []string {
+	e.targetsMtx.Lock()
+	defer e.targetsMtx.Unlock()
+	var result []string
+	for _, dsnList := range e.targets {
+		result = append(result, dsnList...)
+	}
+	return result
+}
+
+// scrapeBackground serves the latest snapshot of a target collected by its scheduler, without querying database
+func (e *Exporter) scrapeBackground(ch chan<- prometheus.Metric, dsn string) error {
+	server, ok := e.servers.lookup(dsn)
+	if !ok {
+		return &ErrorConnectToServer{fmt.Sprintf("Error opening connection to database (%s): not scheduled", ShadowDSN(dsn))}
+	}
+	if err := server.connError(); err != nil {
+		return &ErrorConnectToServer{fmt.Sprintf("Error opening connection to database (%s): %s", ShadowDSN(dsn), err.Error())}
+	}
+	return server.Scrape(ch)
+}
@@ -0,0 +1,210 @@
+// Copyright © 2021 Bin Liu <bin.liu@enmotech.com>
+
+package exporter
+
+import (
+	"fmt"
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestQueryInstance_CollectInterval(t *testing.T) {
+	assert.Equal(t, 60*time.Second, (&QueryInstance{TTL: 60}).CollectInterval())
+	assert.Equal(t, 15*time.Second, (&QueryInstance{TTL: 60, Interval: 15}).CollectInterval())
+	assert.Equal(t, time.Second, (&QueryInstance{TTL: 0.1}).CollectInterval())
+	for i := 0; i < 100; i++ {
+		jitter := collectJitter(10 * time.Second)
+		assert.True(t, jitter >= 0 && jitter <= time.Second)
+	}
+}
+
+func Test_Server_collectDue(t *testing.T) {
+	queryInstance := &QueryInstance{
+		Name:     "pg_lock",
+		Interval: 10,
+		Queries: []*Query{
+			{SQL: "SELECT datname, count FROM pg_locks"},
+		},
+		Metrics: []*Column{
+			{Name: "datname", Usage: LABEL},
+			{Name: "count", Usage: GAUGE},
+		},
+	}
+	s, mock := newMockServer(t, queryInstance)
+	s.background = true
+
+	// nothing collected yet
+	ch := make(chan prometheus.Metric, 10)
+	assert.Empty(t, s.queryMetrics(ch))
+	assert.Len(t, ch, 0)
+
+	now := time.Now()
+	nextRun := make(map[string]time.Time)
+	s.collectDue(now.Add(-2*time.Second), nextRun) // schedules first run with jitter up to 1s
+	expectTxQuery(mock, "SELECT").WillReturnRows(sqlmock.NewRows([]string{"datname", "count"}).AddRow("postgres", 1))
+	s.collectDue(now, nextRun)
+	assert.True(t, nextRun["pg_lock"].After(now.Add(10*time.Second-time.Millisecond)))
+	s.collectDue(now.Add(5*time.Second), nextRun) // not due
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	// scrape serves snapshot without querying database
+	assert.Empty(t, s.queryMetrics(ch))
+	close(ch)
+	var names []string
+	for m := range ch {
+		names = append(names, m.Desc().String())
+		if strings.Contains(m.Desc().String(), "query_snapshot_age_seconds") {
+			pb := &dto.Metric{}
+			assert.NoError(t, m.Write(pb))
+			assert.True(t, pb.GetGauge().GetValue() >= 0)
+		}
+	}
+	assert.Len(t, names, 2)
+
+	// queries removed by config reload are forgotten
+	s.queryInstanceMap = map[string]*QueryInstance{}
+	s.collectDue(now.Add(time.Minute), nextRun)
+	assert.Empty(t, nextRun)
+}
+
+func Test_Server_collectDue_unlocked(t *testing.T) {
+	queryInstance := &QueryInstance{
+		Name:    "pg_lock",
+		Timeout: 2,
+		Queries: []*Query{
+			{SQL: "SELECT datname, count FROM pg_locks"},
+		},
+		Metrics: []*Column{
+			{Name: "datname", Usage: LABEL},
+			{Name: "count", Usage: GAUGE},
+		},
+	}
+	s, mock := newMockServer(t, queryInstance)
+	s.background = true
+	expectTxQuery(mock, "SELECT").WillDelayFor(500 * time.Millisecond).
+		WillReturnRows(sqlmock.NewRows([]string{"datname", "count"}).AddRow("postgres", 1))
+
+	done := make(chan struct{})
+	go func() {
+		s.collectDue(time.Now(), map[string]time.Time{"pg_lock": time.Now().Add(-time.Second)})
+		close(done)
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	// writers and scrapes do not wait for running queries
+	s.setQueryInstanceMap(map[string]*QueryInstance{"pg_lock": queryInstance})
+	assert.Empty(t, s.queryMetrics(make(chan prometheus.Metric, 10)))
+	select {
+	case <-done:
+		t.Error("collection finished before the scrape")
+	default:
+	}
+	<-done
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func Test_Server_refresh(t *testing.T) {
+	db, mock, err := sqlmock.New(sqlmock.MonitorPingsOption(true))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	s := &Server{
+		db:               db,
+		labels:           prometheus.Labels{"server": "localhost:5432"},
+		namespace:        "pg",
+		master:           1,
+		background:       true,
+		queryInstanceMap: map[string]*QueryInstance{},
+		metricCache:      make(map[string]cachedMetrics),
+	}
+	scrape := func() []string {
+		ch := make(chan prometheus.Metric, 10)
+		assert.NoError(t, s.Scrape(ch))
+		close(ch)
+		var names []string
+		for m := range ch {
+			names = append(names, m.Desc().String())
+		}
+		return names
+	}
+
+	mock.ExpectPing()
+	mock.ExpectQuery("SELECT version").WillReturnRows(sqlmock.NewRows([]string{"version", "now", "current_database"}).
+		AddRow("(openGauss 1.0.1 build 89d339ca) compiled at 2020-12-21 11:12:55", time.Now(), "postgres"))
+	mock.ExpectQuery("pg_is_in_recovery").WillReturnRows(sqlmock.NewRows([]string{"pg_is_in_recovery"}).AddRow(false))
+	mock.ExpectQuery("pg_settings").WillReturnRows(sqlmock.NewRows([]string{"name", "setting", "unit", "short_desc", "vartype"}).
+		AddRow("max_connections", "200", "", "Sets the maximum number of concurrent connections.", "integer"))
+	s.refresh()
+	assert.NoError(t, mock.ExpectationsWereMet())
+	assert.Equal(t, "postgres", s.database)
+	assert.Equal(t, "1.0.1", s.lastMapVersion.String())
+	assert.Equal(t, rolePrimary, s.Role())
+
+	// scrapes serve version, settings and role without querying database
+	names := scrape()
+	assert.Len(t, names, 3)
+	assert.Contains(t, strings.Join(names, "\n"), `fqName: "pg_static"`)
+	assert.Contains(t, strings.Join(names, "\n"), `fqName: "pg_settings_max_connections"`)
+	assert.Contains(t, strings.Join(names, "\n"), `fqName: "pg_role"`)
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	// connection error is reported, previous snapshot is kept
+	mock.ExpectPing().WillReturnError(fmt.Errorf("connection refused"))
+	s.refresh()
+	assert.Error(t, s.connError())
+	assert.Len(t, scrape(), 3)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestServers_retain(t *testing.T) {
+	servers := NewServers()
+	var mocks []sqlmock.Sqlmock
+	for _, dsn := range []string{"host=db1", "host=db2"} {
+		db, mock, err := sqlmock.New()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		servers.servers[dsn] = &Server{db: db, labels: prometheus.Labels{"server": dsn}}
+		mocks = append(mocks, mock)
+	}
+	mocks[1].ExpectClose()
+	servers.retain([]string{"host=db1"})
+	_, ok := servers.lookup("host=db1")
+	assert.True(t, ok)
+	_, ok = servers.lookup("host=db2")
+	assert.False(t, ok)
+	assert.NoError(t, mocks[0].ExpectationsWereMet())
+	assert.NoError(t, mocks[1].ExpectationsWereMet())
+}
+
+func TestExporter_syncSchedulers(t *testing.T) {
+	e := &Exporter{
+		dsn:               []string{"host=localhost port=5432"},
+		backgroundCollect: true,
+		metricMap:         map[string]*QueryInstance{},
+	}
+	e.setupServers()
+	defer e.servers.Close()
+	e.syncSchedulers()
+	assert.Equal(t, e.dsn, e.backgroundTargets())
+	server, ok := e.servers.lookup(e.dsn[0])
+	if assert.True(t, ok) {
+		assert.True(t, server.isMaster())
+		assert.NotNil(t, server.done)
+	}
+
+	// targets no longer configured are stopped
+	e.dsn = []string{"host=localhost port=5433"}
+	e.syncSchedulers()
+	_, ok = e.servers.lookup("host=localhost port=5432")
+	assert.False(t, ok)
+	_, ok = e.servers.lookup("host=localhost port=5433")
+	assert.True(t, ok)
+}
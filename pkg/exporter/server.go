@@ -12,9 +12,11 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/common/log"
 	"math"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -27,6 +29,8 @@ type cachedMetrics struct {
 	metrics        []prometheus.Metric
 	lastScrape     time.Time
 	nonFatalErrors []error
+	skipped        bool  // predicate not satisfied, query was not executed
+	err            error // fatal error of execution
 }
 
 // ServerOpt configures a server.
@@ -61,6 +65,14 @@ func ServerWithDisableCache(b bool) ServerOpt {
 		s.disableCache = b
 	}
 }
+
+// ServerWithTags will register given tags to server, which are matched against query tags
+func ServerWithTags(tags []string) ServerOpt {
+	return func(s *Server) {
+		s.tags = append(s.tags, tags...)
+	}
+}
+
 func ServerWithTimeToString(b bool) ServerOpt {
 	return func(s *Server) {
 		s.timeToString = b
@@ -71,24 +83,53 @@ type Server struct {
 	dsn                    string
 	db                     *sql.DB
 	labels                 prometheus.Labels
-	master                 bool
+	tags                   []string
+	master                 int32  // 1 on first dsn (or the dsn given in auto discovery), which reports settings and version
+	role                   string // replication role detected on last scrape, primary or standby
+	database               string // current database detected on last scrape
+	background             bool   // queries are executed by scheduler, scrapes serve cached metrics only
+	done                   chan struct{}
+	schedulerOnce          sync.Once
+	stopOnce               sync.Once
+	roleMtx                sync.RWMutex
 	namespace              string // default prometheus namespace from cmd args
 	disableSettingsMetrics bool
 	disableCache           bool
 	timeToString           bool
+	pool                   poolConfig
+	scrapeBudget           time.Duration // max execution time of queries per scrape, 0 means unlimited
 	// Last version used to calculate metric map. If mismatch on scrape,
-	// then maps are recalculated.
+	// then maps are recalculated. Written under mappingMtx and versionMtx,
+	// read by queries running in background without holding mappingMtx.
 	lastMapVersion semver.Version
+	versionMtx     sync.RWMutex
 	// Currently active metric map
 	queryInstanceMap map[string]*QueryInstance
 	mappingMtx       sync.RWMutex
 	// Currently cached metrics
 	metricCache map[string]cachedMetrics
 	cacheMtx    sync.Mutex
+	// Descriptors of metric columns with the labels of this server
+	descCache map[string]*columnDesc
+	descMtx   sync.Mutex
+	// Difference between database clock and local clock, used by AGE columns
+	clockOffset time.Duration
+	clockMtx    sync.RWMutex
+	// Previous samples of DELTA/RATE columns
+	deltaSamples map[string]deltaSample
+	deltaMtx     sync.Mutex
+	// Execution statistics per query
+	queryStats map[string]*queryStat
+	statsMtx   sync.Mutex
+	// Version and settings metrics and connection error of the last refresh by scheduler
+	statusMetrics []prometheus.Metric
+	connErr       error
+	statusMtx     sync.Mutex
 }
 
 // Close disconnects from OpenGauss.
 func (s *Server) Close() error {
+	s.stopScheduler()
 	if s.db == nil {
 		return nil
 	}
@@ -106,6 +147,143 @@ func (s *Server) Ping() error {
 	return nil
 }
 
+func (s *Server) setClockOffset(offset time.Duration) {
+	s.clockMtx.Lock()
+	defer s.clockMtx.Unlock()
+	s.clockOffset = offset
+}
+
+// dbNow returns current time according to database clock
+func (s *Server) dbNow() time.Time {
+	s.clockMtx.RLock()
+	defer s.clockMtx.RUnlock()
+	return time.Now().Add(s.clockOffset)
+}
+
+// QueryRole detects replication role of the server
+func (s *Server) QueryRole() error {
+	var inRecovery bool
+	if err := s.db.QueryRow("SELECT pg_is_in_recovery();").Scan(&inRecovery); err != nil {
+		s.setRole("")
+		return fmt.Errorf("Error querying replication role on %q: %v ", s, err)
+	}
+	if inRecovery {
+		s.setRole(roleStandby)
+	} else {
+		s.setRole(rolePrimary)
+	}
+	return nil
+}
+
+func (s *Server) setRole(role string) {
+	s.roleMtx.Lock()
+	defer s.roleMtx.Unlock()
+	if s.role != role {
+		log.Infof("Replication role changed on %s: %q -> %q", s, s.role, role)
+	}
+	s.role = role
+}
+
+// Role returns replication role detected on last scrape, empty if unknown
+func (s *Server) Role() string {
+	s.roleMtx.RLock()
+	defer s.roleMtx.RUnlock()
+	return s.role
+}
+
+// checkVersion queries version, clock and current database of server, the version metric is emitted by master only
+func (s *Server) checkVersion(ch chan<- prometheus.Metric) error {
+	log.Debugf("Querying OpenGauss Version on %q", s)
+	localNow := time.Now()
+	versionRow := s.db.QueryRow("SELECT version(), now(), current_database();")
+	var versionString, database string
+	var dbNow time.Time
+	err := versionRow.Scan(&versionString, &dbNow, &database)
+	if err != nil {
+		return fmt.Errorf("Error scanning version string on %q: %v ", s, err)
+	}
+	s.setClockOffset(dbNow.Sub(localNow))
+	semanticVersion, err := parseVersionSem(versionString)
+
+	s.mappingMtx.Lock()
+	s.database = database
+	if err == nil && semanticVersion.NE(s.lastMapVersion) {
+		log.Infof("Semantic Version Changed on %s: %s -> %s", s, s.lastMapVersion, semanticVersion)
+		s.versionMtx.Lock()
+		s.lastMapVersion = semanticVersion
+		s.versionMtx.Unlock()
+	}
+	s.mappingMtx.Unlock()
+	if err != nil {
+		return fmt.Errorf("Error parsing version string on %q: %v ", s, err)
+	}
+
+	versionDesc := prometheus.NewDesc(fmt.Sprintf("%s_%s", s.namespace, staticLabelName),
+		"Version string as reported by OpenGauss", []string{"version", "short_version"}, s.labels)
+	if s.isMaster() {
+		ch <- prometheus.MustNewConstMetric(versionDesc,
+			prometheus.UntypedValue, 1, parseVersion(versionString), semanticVersion.String())
+	}
+	return nil
+}
+
+// initQueryInstanceMap sets query instances of a server which has none yet
+func (s *Server) initQueryInstanceMap(queryInstanceMap map[string]*QueryInstance) {
+	s.mappingMtx.Lock()
+	defer s.mappingMtx.Unlock()
+	if s.queryInstanceMap == nil {
+		s.queryInstanceMap = queryInstanceMap
+	}
+}
+
+// setQueryInstanceMap replaces query instances of server, cached metrics are dropped.
+func (s *Server) setQueryInstanceMap(queryInstanceMap map[string]*QueryInstance) {
+	s.mappingMtx.Lock()
+	defer s.mappingMtx.Unlock()
+	s.queryInstanceMap = queryInstanceMap
+	s.cacheMtx.Lock()
+	s.metricCache = make(map[string]cachedMetrics)
+	s.cacheMtx.Unlock()
+	s.descMtx.Lock()
+	s.descCache = nil
+	s.descMtx.Unlock()
+	s.pruneQueryStats(queryInstanceMap)
+}
+
+// columnDesc get descriptors of a metric column with the labels of this server.
+// They are built once per query map, as query instances are shared by all servers.
+func (s *Server) columnDesc(q *QueryInstance, col *Column) *columnDesc {
+	key := q.Name + "\xff" + col.Name
+	s.descMtx.Lock()
+	defer s.descMtx.Unlock()
+	if d, ok := s.descCache[key]; ok {
+		return d
+	}
+	if s.descCache == nil {
+		s.descCache = make(map[string]*columnDesc)
+	}
+	d := q.newColumnDesc(col, s.labels)
+	s.descCache[key] = d
+	return d
+}
+
+// setMaster marks server as master, which reports settings and version and runs cluster scope queries
+func (s *Server) setMaster() {
+	atomic.StoreInt32(&s.master, 1)
+}
+
+// mapVersion returns the version used to choose query sql
+func (s *Server) mapVersion() semver.Version {
+	s.versionMtx.RLock()
+	defer s.versionMtx.RUnlock()
+	return s.lastMapVersion
+}
+
+// isMaster reports whether server is master, without locking as it is set on every discovery
+func (s *Server) isMaster() bool {
+	return atomic.LoadInt32(&s.master) == 1
+}
+
 // String returns server's fingerprint.
 func (s *Server) String() string {
 	return s.labels[serverLabelName]
@@ -118,118 +296,204 @@ func (s *Server) Scrape(ch chan<- prometheus.Metric) error {
 
 	var err error
 
-	if !s.disableSettingsMetrics && s.master {
+	if s.background {
+		// version and settings are refreshed by scheduler
+		for _, m := range s.statusSnapshot() {
+			ch <- m
+		}
+	} else if !s.disableSettingsMetrics && s.isMaster() {
 		if err = s.querySettings(ch); err != nil {
 			err = fmt.Errorf("error retrieving settings: %s", err)
 		}
 	}
 
+	if role := s.Role(); role != "" {
+		roleDesc := prometheus.NewDesc(prometheus.BuildFQName(s.namespace, "", "role"),
+			"Replication role of OpenGauss, 1 for the current role. Join on server to select other metrics by role", []string{"role"}, s.labels)
+		ch <- prometheus.MustNewConstMetric(roleDesc, prometheus.GaugeValue, 1, role)
+	}
+
 	errMap := s.queryMetrics(ch)
 	if len(errMap) > 0 {
 		err = fmt.Errorf("queryMetrics returned %d errors", len(errMap))
 	}
+	s.collectQueryStats(ch)
 
 	return err
 }
 
 // 查询监控指标. 先判断是否读取缓存. 禁用缓存或者缓存超时,则读取数据库
+// Queries are executed in order of priority, at most pool max open conns at the same time.
 func (s *Server) queryMetrics(ch chan<- prometheus.Metric) map[string]error {
+	var errMtx sync.Mutex
 	metricErrors := make(map[string]error)
 
 	// Start time of collecting metric  采集指标开始时间
 	scrapeStart := time.Now()
-	for metric, queryInstance := range s.queryInstanceMap {
-		log.Debugf("Querying metric : %s", metric)
-
-		querySQL := queryInstance.GetQuerySQL(s.lastMapVersion)
-		if querySQL == nil {
-			log.Errorf("Querying Metric:%s not define querySQL for version %s", metric, s.lastMapVersion.String())
-			continue
-		}
-		if strings.EqualFold(querySQL.Status, statusDisable) {
-			log.Debugf("Querying metric: %s disable. skip", metric)
-			continue
+	budget := &queryBudget{limit: s.scrapeBudget}
+	s.forEachQuery(sortedQueries(s.queryInstanceMap), func(metric string) {
+		if err := s.collectMetric(ch, metric, s.queryInstanceMap[metric], scrapeStart, budget); err != nil {
+			errMtx.Lock()
+			metricErrors[metric] = err
+			errMtx.Unlock()
 		}
-		var (
-			scrapeMetric   = false // Whether to collect indicators from the database 是否从数据库里采集指标
-			cachedMetric   cachedMetrics
-			metrics        []prometheus.Metric
-			nonFatalErrors []error
-			err            error
-		)
-		// Determine whether to enable caching and cache expiration 判断是否启用缓存和缓存过期
-		if !s.disableCache {
-			var found bool
-			// Check if the metric is cached
-			s.cacheMtx.Lock()
-			cachedMetric, found = s.metricCache[metric]
-			s.cacheMtx.Unlock()
-			// If found, check if needs refresh from cache
-			if found {
-				if scrapeStart.Sub(cachedMetric.lastScrape).Seconds() > queryInstance.TTL {
-					scrapeMetric = true
-				}
-			} else {
+	})
+	if s.scrapeBudget > 0 {
+		ch <- prometheus.MustNewConstMetric(s.scrapeBudgetDesc(), prometheus.GaugeValue, float64(atomic.LoadInt64(&budget.skipped)))
+	}
+
+	return metricErrors
+}
+
+// collectMetric emits metrics of a query instance from cache or database, returns error of the query
+func (s *Server) collectMetric(ch chan<- prometheus.Metric, metric string, queryInstance *QueryInstance,
+	scrapeStart time.Time, budget *queryBudget) error {
+	log.Debugf("Querying metric : %s", metric)
+	if !s.matchQuery(metric, queryInstance) {
+		return nil
+	}
+	var (
+		scrapeMetric = false // Whether to collect indicators from the database 是否从数据库里采集指标
+		cachedMetric cachedMetrics
+		found        bool
+	)
+	// Determine whether to enable caching and cache expiration 判断是否启用缓存和缓存过期
+	if !s.disableCache || s.background || budget.limit > 0 {
+		// Check if the metric is cached
+		s.cacheMtx.Lock()
+		cachedMetric, found = s.metricCache[metric]
+		s.cacheMtx.Unlock()
+		// If found, check if needs refresh from cache
+		if found && !s.disableCache {
+			if scrapeStart.Sub(cachedMetric.lastScrape).Seconds() > queryInstance.TTL {
 				scrapeMetric = true
 			}
 		} else {
 			scrapeMetric = true
 		}
-		if scrapeMetric {
-			metrics, nonFatalErrors, err = s.queryMetric(metric, queryInstance)
-		} else {
-			metrics, nonFatalErrors = cachedMetric.metrics, cachedMetric.nonFatalErrors
+	} else {
+		scrapeMetric = true
+	}
+	if s.background {
+		// queries are executed by scheduler, only serve the latest snapshot
+		if !found {
+			return nil
 		}
-
-		// Serious error - a namespace disappeared
-		if err != nil {
-			metricErrors[metric] = err
-			log.Errorf("collect metric %s err %s", metric, err)
-		}
-		// Non-serious errors - likely version or parsing problems.
-		if len(nonFatalErrors) > 0 {
-			var errText string
-			for _, err := range nonFatalErrors {
-				log.Errorf("collect metric nonFatalErrors %s err %s", metric, err)
-				errText += err.Error()
-			}
-			metricErrors[metric] = errors.New(errText)
+		scrapeMetric = false
+		ch <- prometheus.MustNewConstMetric(s.snapshotAgeDesc(), prometheus.GaugeValue,
+			scrapeStart.Sub(cachedMetric.lastScrape).Seconds(), metric)
+	}
+	if scrapeMetric && budget.exhausted() {
+		// serve outdated metrics rather than adding load to database
+		budget.skip()
+		log.Debugf("Querying metric: %s scrape budget %s exhausted. skip", metric, budget.limit)
+		if !found {
+			return nil
 		}
-
-		// Emit the metrics into the channel
-		for _, metric := range metrics {
-			ch <- metric
+		scrapeMetric = false
+	}
+	if scrapeMetric {
+		start := time.Now()
+		cachedMetric = s.runMetric(metric, queryInstance, scrapeStart)
+		budget.spend(time.Since(start))
+		// Only cache if metric is meaningfully cacheable, or could be served when budget is exhausted
+		if queryInstance.TTL > 0 || budget.limit > 0 {
+			s.cacheMetric(metric, cachedMetric)
 		}
+	}
+	if !scrapeMetric {
+		s.countCacheHit(metric)
+	}
+	metrics, nonFatalErrors, err := cachedMetric.metrics, cachedMetric.nonFatalErrors, cachedMetric.err
+	if !scrapeMetric && !s.background {
+		err = nil // fatal errors are reported by the scrape executing the query only
+	}
 
-		if scrapeMetric {
-			// Only cache if metric is meaningfully cacheable
-			if queryInstance.TTL > 0 {
-				s.cacheMtx.Lock()
-				s.metricCache[metric] = cachedMetrics{
-					metrics:        metrics,
-					lastScrape:     scrapeStart,
-					nonFatalErrors: nonFatalErrors,
-				}
-				s.cacheMtx.Unlock()
-			}
+	// Serious error - a namespace disappeared
+	if err != nil {
+		log.Errorf("collect metric %s err %s", metric, err)
+	}
+	// Non-serious errors - likely version or parsing problems.
+	if len(nonFatalErrors) > 0 {
+		var errText string
+		for _, err := range nonFatalErrors {
+			log.Errorf("collect metric nonFatalErrors %s err %s", metric, err)
+			errText += err.Error()
 		}
+		err = errors.New(errText)
 	}
 
-	return metricErrors
+	// Emit the metrics into the channel
+	for _, metric := range metrics {
+		ch <- metric
+	}
+	return err
+}
+
+// matchQuery reports whether a query instance should run on this server
+func (s *Server) matchQuery(metric string, queryInstance *QueryInstance) bool {
+	querySQL := queryInstance.GetQuerySQL(s.lastMapVersion)
+	if querySQL == nil {
+		log.Errorf("Querying Metric:%s not define querySQL for version %s", metric, s.lastMapVersion.String())
+		return false
+	}
+	if strings.EqualFold(querySQL.Status, statusDisable) {
+		log.Debugf("Querying metric: %s disable. skip", metric)
+		return false
+	}
+	if role := s.Role(); !queryInstance.MatchRole(role) {
+		log.Debugf("Querying metric: %s role %s not match server role %s. skip", metric, queryInstance.Role, role)
+		return false
+	}
+	if !queryInstance.MatchScope(s.isMaster(), s.database) {
+		log.Debugf("Querying metric: %s scope %s not match database %s. skip", metric, queryInstance.Scope, s.database)
+		return false
+	}
+	if !querySQL.MatchTags(s.tags) {
+		log.Debugf("Querying metric: %s tags %v not match server tags %v. skip", metric, querySQL.Tags, s.tags)
+		return false
+	}
+	return true
+}
+
+// runMetric executes a query instance, which is skipped if its predicate is not satisfied
+func (s *Server) runMetric(metric string, queryInstance *QueryInstance, scrapeStart time.Time) cachedMetrics {
+	result := cachedMetrics{lastScrape: scrapeStart}
+	start := time.Now()
+	var err error
+	result.metrics, result.nonFatalErrors, err = s.queryMetric(metric, queryInstance)
+	if errors.Is(err, errPredicateNotSatisfied) {
+		result.skipped, err = true, nil
+	}
+	result.err = err
+	if !result.skipped {
+		s.observeExecution(metric, result, time.Since(start))
+	}
+	if queryInstance.Predicate != "" && err == nil {
+		s.setSkipped(metric, result.skipped)
+	}
+	if result.skipped {
+		log.Debugf("Querying metric: %s predicate not satisfied. skip", metric)
+	}
+	return result
+}
+
+func (s *Server) cacheMetric(metric string, cachedMetric cachedMetrics) {
+	s.cacheMtx.Lock()
+	defer s.cacheMtx.Unlock()
+	s.metricCache[metric] = cachedMetric
 }
 
 // 连接数据查询监控指标
 func (s *Server) queryMetric(metricName string, queryInstance *QueryInstance) ([]prometheus.Metric, []error, error) {
 	// 根据版本获取查询sql
-	query := queryInstance.GetQuerySQL(s.lastMapVersion)
+	query := queryInstance.GetQuerySQL(s.mapVersion())
 	if query == nil {
 		// Return success (no pertinent data)
 		return []prometheus.Metric{}, []error{}, nil
 	}
 
 	// Don't fail on a bad scrape of one metric
-	var rows *sql.Rows
-	var err error
 	var ctx context.Context
 
 	if query.Timeout != 0 { // if timeout is provided, use context
@@ -244,21 +508,11 @@ func (s *Server) queryMetric(metricName string, queryInstance *QueryInstance) ([
 	}
 	log.Debugf("queryMetric [%s] executing begin, sql %s", queryInstance.Name, query.SQL)
 
-	rows, err = s.db.QueryContext(ctx, query.SQL)
+	columnNames, rowsData, err := s.queryRows(ctx, metricName, queryInstance.Predicate, query)
 	if err != nil {
-		if strings.Contains(err.Error(), "context deadline exceeded") {
-			log.Errorf("queryMetric [%s] executing timeout %vs", queryInstance.Name, query.Timeout)
-		}
-		log.Errorf("queryMetric [%s] executing err %s", queryInstance.Name, err)
-		return []prometheus.Metric{}, []error{}, fmt.Errorf("Error running queryMetric on database %q query: %s %v ", s, metricName, err)
-	}
-	defer rows.Close() // nolint: errcheck
-
-	var columnNames []string
-	columnNames, err = rows.Columns()
-	if err != nil {
-		return []prometheus.Metric{}, []error{}, errors.New(fmt.Sprintln("Error retrieving column list for: ", metricName, err))
+		return []prometheus.Metric{}, []error{}, err
 	}
+	s.setRows(metricName, len(rowsData))
 
 	// Make a lookup map for the column indices
 	var columnIdx = make(map[string]int, len(columnNames))
@@ -266,85 +520,136 @@ func (s *Server) queryMetric(metricName string, queryInstance *QueryInstance) ([
 		columnIdx[n] = i
 	}
 
-	var columnData = make([]interface{}, len(columnNames))
-	var scanArgs = make([]interface{}, len(columnNames))
-	for i := range columnData {
-		scanArgs[i] = &columnData[i]
-	}
-
 	nonfatalErrors := []error{}
 
+	if queryInstance.SortColumn != "" {
+		if sortIdx, ok := columnIdx[queryInstance.SortColumn]; ok {
+			sortRows(rowsData, sortIdx, queryInstance.SortOrder == sortOrderAsc)
+		} else {
+			nonfatalErrors = append(nonfatalErrors, fmt.Errorf("Missing sort column %s for %s ", queryInstance.SortColumn, metricName))
+		}
+	}
+
 	metrics := make([]prometheus.Metric, 0)
+	droppedSeries := 0
 
-	for rows.Next() {
-		err = rows.Scan(scanArgs...)
-		if err != nil {
-			return []prometheus.Metric{}, []error{}, errors.New(fmt.Sprintln("Error retrieving rows:", metricName, err))
-		}
+	var infoDesc *prometheus.Desc
+	if queryInstance.Info {
+		infoDesc = queryInstance.InfoDesc(s.labels)
+	}
+	scrapeTime := time.Now()
+	defer s.pruneDeltaSamples(scrapeTime)
+
+	// metric name and label values already emitted in pivot mode
+	pivotSeen := make(map[string]bool)
+
+	for _, columnData := range rowsData {
+		rowMetrics := make([]prometheus.Metric, 0, len(columnNames))
 
 		// Get the label values for this row.
 		labels := make([]string, len(queryInstance.LabelNames))
 		for idx, label := range queryInstance.LabelNames {
 			labels[idx], _ = dbToString(columnData[columnIdx[label]], s.timeToString)
 		}
+		if infoDesc != nil {
+			rowMetrics = append(rowMetrics, prometheus.MustNewConstMetric(infoDesc, prometheus.GaugeValue, 1, labels...))
+		}
+		if queryInstance.KeyColumn != "" {
+			metric, pivotErr := s.pivotMetric(queryInstance, columnIdx, columnData, labels, pivotSeen)
+			var parseErr *ErrorParseValue
+			if errors.As(pivotErr, &parseErr) && queryInstance.Columns[queryInstance.ValueColumn].OnError == onErrorFail {
+				return []prometheus.Metric{}, []error{}, fmt.Errorf("Error pivoting row of %s: %w ", metricName, pivotErr)
+			}
+			if pivotErr != nil {
+				nonfatalErrors = append(nonfatalErrors, fmt.Errorf("Error pivoting row of %s: %w ", metricName, pivotErr))
+			} else if metric != nil {
+				rowMetrics = append(rowMetrics, metric)
+			}
+		}
 
 		// Loop over column names, and match to scan data. Unknown columns
 		// will be filled with an untyped metric number *if* they can be
 		// converted to float64s. NULLs are allowed and treated as NaN.
 		for idx, columnName := range columnNames {
 			var metric prometheus.Metric
-			col := queryInstance.GetColumn(columnName, s.labels)
+			if queryInstance.KeyColumn != "" && columnName == queryInstance.ValueColumn {
+				continue // already emitted as pivot metric
+			}
+			col := queryInstance.GetColumn(columnName)
 			if col != nil {
 				if col.DisCard {
 					continue
 				}
-				/*
-					WITH data AS (SELECT floor(random()*10) AS d FROM generate_series(1,100)),
-					         metrics AS (SELECT SUM(d) AS sum, COUNT(*) AS count FROM data),
-					         buckets AS (SELECT le, SUM(CASE WHEN d <= le THEN 1 ELSE 0 END) AS d
-					                     FROM data, UNNEST(ARRAY[1, 2, 4, 8]) AS le GROUP BY le)
-					    SELECT
-					      sum AS histogram_sum,
-					      count AS histogram_count,
-					      ARRAY_AGG(le) AS histogram,
-					      ARRAY_AGG(d) AS histogram_bucket,
-					      ARRAY_AGG(le) AS missing,
-					      ARRAY_AGG(le) AS missing_sum,
-					      ARRAY_AGG(d) AS missing_sum_bucket,
-					      ARRAY_AGG(le) AS missing_count,
-					      ARRAY_AGG(d) AS missing_count_bucket,
-					      sum AS missing_count_sum,
-					      ARRAY_AGG(le) AS unexpected_sum,
-					      ARRAY_AGG(d) AS unexpected_sum_bucket,
-					      'data' AS unexpected_sum_sum,
-					      ARRAY_AGG(le) AS unexpected_count,
-					      ARRAY_AGG(d) AS unexpected_count_bucket,
-					      sum AS unexpected_count_sum,
-					      'nan'::varchar AS unexpected_count_count,
-					      ARRAY_AGG(le) AS unexpected_bytes,
-					      ARRAY_AGG(d) AS unexpected_bytes_bucket,
-					      sum AS unexpected_bytes_sum,
-					      'nan'::bytea AS unexpected_bytes_count
-					    FROM metrics, buckets GROUP BY 1,2
-				*/
+				d := s.columnDesc(queryInstance, col)
 				if col.Histogram {
-
+					var histErr error
+					if metric, histErr = histogramMetric(col, d.desc, columnIdx, columnData, labels); histErr != nil {
+						nonfatalErrors = append(nonfatalErrors, fmt.Errorf("Error parsing histogram column %s %s: %w ", metricName, columnName, &ErrorParseValue{histErr.Error()}))
+						continue
+					}
 				} else if strings.EqualFold(col.Usage, MappedMETRIC) {
-
+					text, _ := dbToString(columnData[idx], s.timeToString)
+					value, ok := col.MappedValue(text)
+					if !ok {
+						nonfatalErrors = append(nonfatalErrors, &ErrorParseValue{fmt.Sprintf("Unmapped value for column %s %s: %q ", metricName, columnName, text)})
+						continue
+					}
+					metric = prometheus.MustNewConstMetric(d.desc, d.valueType, value, labels...)
+				} else if col.Usage == STATESET {
+					text, _ := dbToString(columnData[idx], s.timeToString)
+					for i, value := range col.StateValues(text) {
+						rowMetrics = append(rowMetrics, prometheus.MustNewConstMetric(d.desc, d.valueType, value, append(labels, col.States[i])...))
+					}
+					continue
 				} else {
-					value, ok := dbToFloat64(columnData[idx])
+					value, ok, parseErr := col.Value(columnData[idx])
+					if parseErr != nil {
+						if col.OnError == onErrorFail {
+							return []prometheus.Metric{}, []error{}, fmt.Errorf("Error parsing column %s %s: %w ", metricName, columnName, parseErr)
+						}
+						nonfatalErrors = append(nonfatalErrors, fmt.Errorf("Unexpected error parsing column: %s %s: %w ", metricName, columnName, parseErr))
+					}
 					if !ok {
-						nonfatalErrors = append(nonfatalErrors, errors.New(fmt.Sprintln("Unexpected error parsing column: ", metricName, columnName, columnData[idx])))
 						continue
 					}
+					if col.Usage == AGE {
+						value = float64(s.dbNow().UnixNano())/1e9 - value
+					}
+					if col.LagFrom != "" {
+						lagIdx, found := columnIdx[col.LagFrom]
+						if !found {
+							nonfatalErrors = append(nonfatalErrors, fmt.Errorf("Missing lag_from column %s for %s %s ", col.LagFrom, metricName, columnName))
+							continue
+						}
+						base, baseOk := dbToLSN(columnData[lagIdx])
+						if !baseOk {
+							nonfatalErrors = append(nonfatalErrors, &ErrorParseValue{fmt.Sprintf("Unexpected lag_from value for %s %s: %v ", metricName, columnName, columnData[lagIdx])})
+							continue
+						}
+						value = base - value
+					}
+					// Convert to base unit, unit has been validated by QueryInstance.Check
+					value, _, _ = normaliseUnit(value, col.Unit)
+					if col.Usage == DELTA || col.Usage == RATE {
+						if col.Raw {
+							rowMetrics = append(rowMetrics, prometheus.MustNewConstMetric(d.rawDesc, prometheus.CounterValue, value, labels...))
+						}
+						key := d.desc.String() + strings.Join(labels, "\xff")
+						if value, ok = s.deltaValue(key, col.Usage == RATE, value, scrapeTime); !ok {
+							continue
+						}
+					}
 					// Generate the metric
-					metric = prometheus.MustNewConstMetric(col.PrometheusDesc, col.PrometheusType, value, labels...)
+					metric = prometheus.MustNewConstMetric(d.desc, d.valueType, value, labels...)
 				}
 
 			} else {
 				// Unknown metric. Report as untyped if scan to float64 works, else note an error too.
 				metricLabel := fmt.Sprintf("%s_%s", metricName, columnName)
-				desc := prometheus.NewDesc(metricLabel, fmt.Sprintf("Unknown metric from %s", metricName), queryInstance.LabelNames, s.labels)
+				if queryInstance.MetricPrefix != "" {
+					metricLabel = fmt.Sprintf("%s_%s", queryInstance.MetricPrefix, columnName)
+				}
+				desc := prometheus.NewDesc(metricLabel, fmt.Sprintf("Unknown metric from %s", metricName), queryInstance.LabelKeys, s.labels)
 
 				// Its not an error to fail here, since the values are
 				// unexpected anyway.
@@ -355,16 +660,130 @@ func (s *Server) queryMetric(metricName string, queryInstance *QueryInstance) ([
 				}
 				metric = prometheus.MustNewConstMetric(desc, prometheus.UntypedValue, value, labels...)
 			}
-			metrics = append(metrics, metric)
+			rowMetrics = append(rowMetrics, metric)
+		}
+
+		// Keep whole rows only, the first row exceeding the limit truncates the rest
+		if queryInstance.MaxSeries > 0 && (droppedSeries > 0 || len(metrics)+len(rowMetrics) > queryInstance.MaxSeries) {
+			droppedSeries += len(rowMetrics)
+			continue
 		}
+		metrics = append(metrics, rowMetrics...)
 	}
-	if err = rows.Err(); err != nil {
-		log.Debugf("queryMetric [%s] rows error %s", metricName, err)
-		return []prometheus.Metric{}, []error{}, err
+	if queryInstance.MaxSeries > 0 {
+		if droppedSeries > 0 {
+			log.Warnf("queryMetric [%s] drop %d series exceeding max_series %d", metricName, droppedSeries, queryInstance.MaxSeries)
+		}
+		s.setDroppedSeries(metricName, droppedSeries)
 	}
 	return metrics, nonfatalErrors, nil
 }
 
+// pivotMetric build a metric from a key/value row, where the metric name is
+// taken from the key column and the value from the value column.
+func (s *Server) pivotMetric(q *QueryInstance, columnIdx map[string]int, columnData []interface{}, labels []string, seen map[string]bool) (prometheus.Metric, error) {
+	keyIdx, ok := columnIdx[q.KeyColumn]
+	if !ok {
+		return nil, fmt.Errorf("missing key column %s", q.KeyColumn)
+	}
+	valueIdx, ok := columnIdx[q.ValueColumn]
+	if !ok {
+		return nil, fmt.Errorf("missing value column %s", q.ValueColumn)
+	}
+	key, _ := dbToString(columnData[keyIdx], s.timeToString)
+	if sanitizeMetricName(key) == "" {
+		return nil, fmt.Errorf("invalid metric name %q in key column %s", key, q.KeyColumn)
+	}
+	col := q.Columns[q.ValueColumn]
+	value, ok, err := col.Value(columnData[valueIdx])
+	if err != nil {
+		return nil, fmt.Errorf("unexpected value for %s: %w", key, err)
+	}
+	if !ok {
+		return nil, nil
+	}
+	value, _, _ = normaliseUnit(value, col.Unit)
+
+	desc := q.PivotDesc(key, s.labels)
+	fingerprint := desc.String() + strings.Join(labels, "\xff")
+	if seen[fingerprint] {
+		return nil, fmt.Errorf("duplicate key %q", key)
+	}
+	seen[fingerprint] = true
+
+	valueType := prometheus.GaugeValue
+	if col.Usage == COUNTER {
+		valueType = prometheus.CounterValue
+	}
+	return prometheus.MustNewConstMetric(desc, valueType, value, labels...), nil
+}
+
+// histogramMetric build a const histogram from a HISTOGRAM column and its
+// _bucket, _sum and _count companions, e.g.
+//
+//	WITH data AS (SELECT floor(random()*10) AS d FROM generate_series(1,100)),
+//	     metrics AS (SELECT SUM(d) AS sum, COUNT(*) AS count FROM data),
+//	     buckets AS (SELECT le, SUM(CASE WHEN d <= le THEN 1 ELSE 0 END) AS d
+//	                 FROM data, UNNEST(ARRAY[1, 2, 4, 8]) AS le GROUP BY le)
+//	SELECT
+//	  sum AS histogram_sum,
+//	  count AS histogram_count,
+//	  ARRAY_AGG(le) AS histogram,
+//	  ARRAY_AGG(d) AS histogram_bucket
+//	FROM metrics, buckets GROUP BY 1,2
+func histogramMetric(col *Column, desc *prometheus.Desc, columnIdx map[string]int, columnData []interface{}, labels []string) (prometheus.Metric, error) {
+	var keys []float64
+	if err := pq.Array(&keys).Scan(columnData[columnIdx[col.Name]]); err != nil {
+		return nil, fmt.Errorf("invalid bucket bounds: %v", err)
+	}
+
+	bucketIdx, ok := columnIdx[col.Name+histogramBucketSuffix]
+	if !ok {
+		return nil, fmt.Errorf("missing column %s%s", col.Name, histogramBucketSuffix)
+	}
+	var values []int64
+	if err := pq.Array(&values).Scan(columnData[bucketIdx]); err != nil {
+		return nil, fmt.Errorf("invalid bucket counts: %v", err)
+	}
+	if len(keys) != len(values) {
+		return nil, fmt.Errorf("bucket bounds and counts length mismatch: %d != %d", len(keys), len(values))
+	}
+
+	buckets := make(map[float64]uint64, len(keys))
+	for i, key := range keys {
+		if i > 0 && key <= keys[i-1] {
+			return nil, fmt.Errorf("bucket bounds are not increasing: %v after %v", key, keys[i-1])
+		}
+		if values[i] < 0 || (i > 0 && values[i] < values[i-1]) {
+			return nil, fmt.Errorf("bucket counts are not cumulative: %v at le %v", values[i], key)
+		}
+		buckets[key] = uint64(values[i])
+	}
+
+	sumIdx, ok := columnIdx[col.Name+histogramSumSuffix]
+	if !ok {
+		return nil, fmt.Errorf("missing column %s%s", col.Name, histogramSumSuffix)
+	}
+	sum, ok := dbToFloat64(columnData[sumIdx])
+	if !ok {
+		return nil, fmt.Errorf("unexpected value for %s%s: %v", col.Name, histogramSumSuffix, columnData[sumIdx])
+	}
+
+	countIdx, ok := columnIdx[col.Name+histogramCountSuffix]
+	if !ok {
+		return nil, fmt.Errorf("missing column %s%s", col.Name, histogramCountSuffix)
+	}
+	count, ok := dbToFloat64(columnData[countIdx])
+	if !ok || math.IsNaN(count) || count < 0 {
+		return nil, fmt.Errorf("unexpected value for %s%s: %v", col.Name, histogramCountSuffix, columnData[countIdx])
+	}
+	if len(values) > 0 && uint64(values[len(values)-1]) > uint64(count) {
+		return nil, fmt.Errorf("bucket count %d exceeds total count %v", values[len(values)-1], count)
+	}
+
+	return prometheus.NewConstHistogram(desc, uint64(count), sum, buckets, labels...)
+}
+
 func (s *Server) QueryDatabases() ([]string, error) {
 	rows, err := s.db.Query(`SELECT datname FROM pg_database
 	WHERE datallowconn = true
@@ -395,32 +814,43 @@ func NewServer(dsn string, opts ...ServerOpt) (*Server, error) {
 		return nil, err
 	}
 
-	db, err := sql.Open("postgres", dsn)
+	connDSN, tags, err := splitDSNTags(dsn)
 	if err != nil {
 		return nil, err
 	}
-	db.SetMaxOpenConns(1)
-	db.SetMaxIdleConns(1)
-
-	log.Infof("Established new database connection to %q.", fingerprint)
 
 	s := &Server{
-		db:     db,
-		dsn:    dsn,
-		master: false,
+		dsn: dsn,
 		labels: prometheus.Labels{
 			serverLabelName: fingerprint,
 		},
 		metricCache: make(map[string]cachedMetrics),
+		pool:        defaultPoolConfig(),
 	}
 
 	for _, opt := range opts {
 		opt(s)
 	}
+	s.tags = append(s.tags, tags...)
+
+	// pool settings in dsn override the ones of options
+	if connDSN, err = splitDSNPool(connDSN, &s.pool); err != nil {
+		return nil, err
+	}
+
+	if s.db, err = sql.Open("postgres", connDSN); err != nil {
+		return nil, err
+	}
+	s.applyPool()
+
+	log.Infof("Established new database connection to %q.", fingerprint)
 
 	return s, nil
 }
 
+// connectRetryDelay is multiplied by number of failed attempts before connecting again
+var connectRetryDelay = time.Second
+
 // Servers contains a collection of servers to OpenGauss.
 type Servers struct {
 	m       sync.Mutex
@@ -438,36 +868,86 @@ func NewServers(opts ...ServerOpt) *Servers {
 
 // GetServer returns established connection from a collection.
 func (s *Servers) GetServer(dsn string) (*Server, error) {
-	s.m.Lock()
-	defer s.m.Unlock()
 	var err error
-	var ok bool
-	errCount := 0 // start at zero because we increment before doing work
 	retries := 3
-	var server *Server
-	for {
-		if errCount++; errCount > retries {
-			return nil, err
-		}
-		server, ok = s.servers[dsn]
-		if !ok {
-			server, err = NewServer(dsn, s.opts...)
-			if err != nil {
-				time.Sleep(time.Duration(errCount) * time.Second)
-				continue
+	for errCount := 1; ; errCount++ {
+		var server *Server
+		// connection is checked without holding the lock, so that an unreachable
+		// server does not block other servers
+		if server, err = s.server(dsn); err == nil {
+			if err = server.Ping(); err == nil {
+				return server, nil
 			}
-			s.servers[dsn] = server
+			s.removeServer(dsn, server)
 		}
-		if err = server.Ping(); err != nil {
-			delete(s.servers, dsn)
-			time.Sleep(time.Duration(errCount) * time.Second)
-			continue
+		if errCount >= retries {
+			return nil, err
 		}
-		break
+		time.Sleep(time.Duration(errCount) * connectRetryDelay)
+	}
+}
+
+// server returns known server of dsn, or creates a new one
+func (s *Servers) server(dsn string) (*Server, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if server, ok := s.servers[dsn]; ok {
+		return server, nil
+	}
+	server, err := NewServer(dsn, s.opts...)
+	if err != nil {
+		return nil, err
 	}
+	s.servers[dsn] = server
 	return server, nil
 }
 
+// lookup returns known server of dsn, without connecting to it
+func (s *Servers) lookup(dsn string) (*Server, bool) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	server, ok := s.servers[dsn]
+	return server, ok
+}
+
+// retain closes and forgets servers whose dsn is not in dsnList, which also stops their schedulers
+func (s *Servers) retain(dsnList []string) {
+	keep := make(map[string]bool, len(dsnList))
+	for _, dsn := range dsnList {
+		keep[dsn] = true
+	}
+	s.m.Lock()
+	defer s.m.Unlock()
+	for dsn, server := range s.servers {
+		if keep[dsn] {
+			continue
+		}
+		log.Infof("Closing connection to %q, which is no longer discovered", server)
+		if err := server.Close(); err != nil {
+			log.Errorf("failed to close connection to %q: %v", server, err)
+		}
+		delete(s.servers, dsn)
+	}
+}
+
+// removeServer forgets server of dsn, unless it has been replaced already
+func (s *Servers) removeServer(dsn string, server *Server) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.servers[dsn] == server {
+		delete(s.servers, dsn)
+	}
+}
+
+// setQueryInstanceMap replaces query instances of all known servers, cached metrics are dropped.
+func (s *Servers) setQueryInstanceMap(queryInstanceMap map[string]*QueryInstance) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	for _, server := range s.servers {
+		server.setQueryInstanceMap(queryInstanceMap)
+	}
+}
+
 // Close disconnects from all known servers.
 func (s *Servers) Close() {
 	s.m.Lock()
@@ -517,6 +997,180 @@ func dbToFloat64(t interface{}) (float64, bool) {
 	}
 }
 
+// sortRows sort rows by the given column, numerically if both values can be
+// converted to float64s and as strings otherwise. NULLs always come last.
+func sortRows(rows [][]interface{}, idx int, asc bool) {
+	sort.SliceStable(rows, func(i, j int) bool {
+		a, b := rows[i][idx], rows[j][idx]
+		if a == nil || b == nil {
+			return a != nil && b == nil
+		}
+		fa, okA := dbToFloat64(a)
+		fb, okB := dbToFloat64(b)
+		if okA && okB && !math.IsNaN(fa) && !math.IsNaN(fb) {
+			if asc {
+				return fa < fb
+			}
+			return fa > fb
+		}
+		sa, _ := dbToString(a, true)
+		sb, _ := dbToString(b, true)
+		if asc {
+			return sa < sb
+		}
+		return sa > sb
+	})
+}
+
+// Convert WAL location like 0/3000060 to byte offset. Numeric values are taken
+// as byte offset already. Null types are mapped to NaN.
+func dbToLSN(t interface{}) (float64, bool) {
+	var strV string
+	switch v := t.(type) {
+	case []byte:
+		strV = string(v)
+	case string:
+		strV = v
+	case nil:
+		return math.NaN(), true
+	default:
+		return dbToFloat64(t)
+	}
+	parts := strings.Split(strings.TrimSpace(strV), "/")
+	if len(parts) != 2 {
+		return math.NaN(), false
+	}
+	hi, err := strconv.ParseUint(parts[0], 16, 32)
+	if err != nil {
+		return math.NaN(), false
+	}
+	lo, err := strconv.ParseUint(parts[1], 16, 32)
+	if err != nil {
+		return math.NaN(), false
+	}
+	return float64(hi<<32 | lo), true
+}
+
+// timestampLayouts are text formats of timestamp values, with or without time zone
+var timestampLayouts = []string{
+	"2006-01-02 15:04:05.999999999-07",
+	"2006-01-02 15:04:05.999999999-07:00",
+	"2006-01-02 15:04:05.999999999",
+	time.RFC3339Nano,
+}
+
+// Convert timestamp to Unix seconds with fraction. Text values are parsed,
+// numeric values are taken as Unix seconds already. Null types are mapped to NaN.
+func dbToTimestamp(t interface{}) (float64, bool) {
+	var strV string
+	switch v := t.(type) {
+	case time.Time:
+		return float64(v.UnixNano()) / 1e9, true
+	case []byte:
+		strV = string(v)
+	case string:
+		strV = v
+	case nil:
+		return math.NaN(), true
+	default:
+		return dbToFloat64(t)
+	}
+	strV = strings.TrimSpace(strV)
+	for _, layout := range timestampLayouts {
+		if ts, err := time.Parse(layout, strV); err == nil {
+			return float64(ts.UnixNano()) / 1e9, true
+		}
+	}
+	return math.NaN(), false
+}
+
+// intervalUnits are seconds of PostgreSQL interval units, with a month of 30
+// days and a year of 365.25 days as extract(epoch from interval) does
+var intervalUnits = map[string]float64{
+	"microsecond": 1e-6, "microseconds": 1e-6, "us": 1e-6,
+	"millisecond": 1e-3, "milliseconds": 1e-3, "ms": 1e-3,
+	"second": 1, "seconds": 1, "sec": 1, "secs": 1, "s": 1,
+	"minute": 60, "minutes": 60, "min": 60, "mins": 60, "m": 60,
+	"hour": 3600, "hours": 3600, "h": 3600,
+	"day": 86400, "days": 86400, "d": 86400,
+	"week": 604800, "weeks": 604800,
+	"mon": 2592000, "mons": 2592000, "month": 2592000, "months": 2592000,
+	"year": 31557600, "years": 31557600,
+}
+
+// Convert PostgreSQL / openGauss interval text such as "1 day 02:03:04.5",
+// "-00:00:01" or "@ 3 mins 2 secs ago" to seconds. Numeric values are taken
+// as seconds already. Null types are mapped to NaN.
+func dbToInterval(t interface{}) (float64, bool) {
+	var strV string
+	switch v := t.(type) {
+	case []byte:
+		strV = string(v)
+	case string:
+		strV = v
+	case nil:
+		return math.NaN(), true
+	default:
+		return dbToFloat64(t)
+	}
+	fields := strings.Fields(strings.ToLower(strV))
+	if len(fields) == 0 {
+		return math.NaN(), false
+	}
+	var seconds float64
+	sign := 1.0
+	for i := 0; i < len(fields); i++ {
+		field := fields[i]
+		switch {
+		case field == "@":
+			continue
+		case field == "ago":
+			sign = -1
+		case strings.Contains(field, ":"):
+			v, ok := parseIntervalTime(field)
+			if !ok {
+				return math.NaN(), false
+			}
+			seconds += v
+		default:
+			v, err := strconv.ParseFloat(field, 64)
+			if err != nil || i+1 >= len(fields) {
+				return math.NaN(), false
+			}
+			unit, ok := intervalUnits[fields[i+1]]
+			if !ok {
+				return math.NaN(), false
+			}
+			seconds += v * unit
+			i++
+		}
+	}
+	return sign * seconds, true
+}
+
+// parseIntervalTime parse the [-]HH:MM[:SS[.ffffff]] part of interval text
+func parseIntervalTime(s string) (float64, bool) {
+	sign := 1.0
+	if strings.HasPrefix(s, "-") {
+		sign, s = -1, s[1:]
+	} else if strings.HasPrefix(s, "+") {
+		s = s[1:]
+	}
+	parts := strings.Split(s, ":")
+	if len(parts) < 2 || len(parts) > 3 {
+		return 0, false
+	}
+	var seconds float64
+	for i, part := range parts {
+		v, err := strconv.ParseFloat(part, 64)
+		if err != nil || v < 0 {
+			return 0, false
+		}
+		seconds += v * math.Pow(60, float64(2-i))
+	}
+	return sign * seconds, true
+}
+
 // Convert database.sql to string for Prometheus labels. Null types are mapped to empty strings.
 func dbToString(t interface{}, time2string bool) (string, bool) {
 	switch v := t.(type) {
@@ -4,11 +4,15 @@ package exporter
 
 import (
 	"database/sql"
+	"database/sql/driver"
 	"fmt"
 	"github.com/DATA-DOG/go-sqlmock"
 	"github.com/blang/semver"
+	"github.com/lib/pq"
 	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
 	"github.com/stretchr/testify/assert"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -240,7 +244,6 @@ func Test_Server(t *testing.T) {
 			labels: prometheus.Labels{
 				"server": "localhost:5432",
 			},
-			master:                 false,
 			namespace:              "",
 			disableSettingsMetrics: false,
 			disableCache:           false,
@@ -267,7 +270,7 @@ func Test_Server(t *testing.T) {
 			t.Error(err)
 		}
 		s.db = db
-		mock.ExpectQuery("SELECT").WillReturnRows(
+		expectTxQuery(mock, "SELECT").WillReturnRows(
 			sqlmock.NewRows([]string{"datname", "mode", "count"}).FromCSVString(`postgres,AccessShareLock,4
 omm,RowShareLock,0
 postgres,ShareRowExclusiveLock,0
@@ -296,6 +299,7 @@ postgres,AccessExclusiveLock,0`))
 		}
 		s.db = db
 		queryInstance.Queries[0].Timeout = 0
+		mock.ExpectBegin() // timeouts are not set in transaction
 		mock.ExpectQuery("SELECT").WillReturnRows(
 			sqlmock.NewRows([]string{"datname", "mode", "count"}).FromCSVString(`postgres,AccessShareLock,4
 omm,RowShareLock,0
@@ -313,10 +317,12 @@ postgres,ShareUpdateExclusiveLock,0
 omm,AccessExclusiveLock,0
 postgres,RowShareLock,0
 postgres,AccessExclusiveLock,0`))
+		mock.ExpectRollback()
 		metrics, errs, err := s.queryMetric(metricName, queryInstance)
 		assert.NoError(t, err)
 		assert.ElementsMatch(t, errs, []error{})
 		assert.NotNil(t, metrics)
+		assert.NoError(t, mock.ExpectationsWereMet())
 	})
 	t.Run("queryMetric_query_nil", func(t *testing.T) {
 		metrics, errs, err := s.queryMetric(metricName, &QueryInstance{})
@@ -331,7 +337,7 @@ postgres,AccessExclusiveLock,0`))
 			t.Error(err)
 		}
 		s.db = db
-		mock.ExpectQuery("SELECT").WillDelayFor(1 * time.Second).WillReturnRows(
+		expectTxQuery(mock, "SELECT").WillDelayFor(1 * time.Second).WillReturnRows(
 			sqlmock.NewRows([]string{"datname", "mode", "count"}).FromCSVString(`postgres,AccessShareLock,4
 omm,RowShareLock,0
 postgres,ShareRowExclusiveLock,0
@@ -350,6 +356,7 @@ postgres,RowShareLock,0
 postgres,AccessExclusiveLock,0`))
 		metrics, errs, err := s.queryMetric(metricName, queryInstance)
 		assert.Error(t, err)
+		assert.IsType(t, &ErrorQueryTimeout{}, err)
 		assert.ElementsMatch(t, []error{}, errs)
 		assert.ElementsMatch(t, []prometheus.Metric{}, metrics)
 	})
@@ -359,7 +366,7 @@ postgres,AccessExclusiveLock,0`))
 			t.Error(err)
 		}
 		s.db = db
-		mock.ExpectQuery("SELECT").WillReturnError(fmt.Errorf("error"))
+		expectTxQuery(mock, "SELECT").WillReturnError(fmt.Errorf("error"))
 		metrics, errs, err := s.queryMetric(metricName, queryInstance)
 		assert.Error(t, err)
 		assert.ElementsMatch(t, []error{}, errs)
@@ -431,7 +438,7 @@ omm`))
 			t.Error(err)
 		}
 		s.db = db
-		mock.ExpectQuery("SELECT").WillDelayFor(1 * time.Second).WillReturnRows(
+		expectTxQuery(mock, "SELECT").WillDelayFor(1 * time.Second).WillReturnRows(
 			sqlmock.NewRows([]string{"pid", "usesysid", "usename", "application_name", "client_addr", "client_hostname", "client_port", "backend_start", "state", "sender_sent_location",
 				"receiver_write_location", "receiver_flush_location", "receiver_replay_location", "sync_priority", "sync_state", "pg_current_xlog_location", "pg_xlog_location_diff",
 			}).FromCSVString(`140215315789568,10,omm,"WalSender to Standby","192.168.122.92","kvm-yl2",55802,"2021-01-06 14:45:59.944279+08","Streaming","0/331980B8","0/331980B8","0/331980B8","0/331980B8",1,Sync,"0/331980B8",0`))
@@ -474,3 +481,807 @@ omm`))
 	//
 	// })
 }
+
+func Test_Server_queryMetric_histogram(t *testing.T) {
+	queryInstance := &QueryInstance{
+		Name: "pg_histogram",
+		Queries: []*Query{
+			{SQL: "SELECT datname, histogram, histogram_bucket, histogram_sum, histogram_count FROM dual"},
+		},
+		Metrics: []*Column{
+			{Name: "datname", Usage: LABEL},
+			{Name: "histogram", Usage: HISTOGRAM, Desc: "histogram"},
+		},
+	}
+	columns := []string{"datname", "histogram", "histogram_bucket", "histogram_sum", "histogram_count"}
+	tests := []struct {
+		name    string
+		row     []driver.Value
+		want    int
+		wantErr bool
+	}{
+		{
+			name: "histogram",
+			row:  []driver.Value{"postgres", "{1,2,4,8}", "{3,5,7,10}", "45", "10"},
+			want: 1,
+		},
+		{
+			name:    "length_mismatch",
+			row:     []driver.Value{"postgres", "{1,2,4,8}", "{3,5,7}", "45", "10"},
+			wantErr: true,
+		},
+		{
+			name:    "bounds_not_increasing",
+			row:     []driver.Value{"postgres", "{1,4,2,8}", "{3,5,7,10}", "45", "10"},
+			wantErr: true,
+		},
+		{
+			name:    "counts_not_cumulative",
+			row:     []driver.Value{"postgres", "{1,2,4,8}", "{3,5,4,10}", "45", "10"},
+			wantErr: true,
+		},
+		{
+			name:    "count_too_small",
+			row:     []driver.Value{"postgres", "{1,2,4,8}", "{3,5,7,10}", "45", "9"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, mock := newMockServer(t, queryInstance)
+			expectTxQuery(mock, "SELECT").WillReturnRows(sqlmock.NewRows(columns).AddRow(tt.row...))
+			metrics, errs, err := s.queryMetric("pg_histogram", queryInstance)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.wantErr, len(errs) > 0)
+			assert.Len(t, metrics, tt.want)
+		})
+	}
+}
+
+func Test_Server_queryMetric_mapped(t *testing.T) {
+	unknown := float64(-1)
+	queryInstance := &QueryInstance{
+		Name: "pg_stat_replication",
+		Queries: []*Query{
+			{SQL: "SELECT application_name, sync_state FROM pg_stat_replication"},
+		},
+		Metrics: []*Column{
+			{Name: "application_name", Usage: LABEL},
+			{Name: "sync_state", Usage: MappedMETRIC, Mapping: map[string]float64{"Async": 0, "Sync": 1, "Potential": 2}, MappingDefault: &unknown},
+		},
+	}
+	s, mock := newMockServer(t, queryInstance)
+	expectTxQuery(mock, "SELECT").WillReturnRows(
+		sqlmock.NewRows([]string{"application_name", "sync_state"}).FromCSVString(`standby1,Sync
+standby2,async
+standby3,Quorum`))
+	metrics, errs, err := s.queryMetric("pg_stat_replication", queryInstance)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []error{}, errs)
+	assert.Len(t, metrics, 3)
+
+	col := queryInstance.Columns["sync_state"]
+	col.MappingDefault = nil
+	_, ok := col.MappedValue("Quorum")
+	assert.False(t, ok)
+	v, ok := col.MappedValue("POTENTIAL")
+	assert.True(t, ok)
+	assert.Equal(t, float64(2), v)
+}
+
+func Test_Server_queryMetric_unit(t *testing.T) {
+	queryInstance := &QueryInstance{
+		Name: "pg_stat_bgwriter",
+		Queries: []*Query{
+			{SQL: "SELECT checkpoint_write_time, buffers_checkpoint, flush_time FROM pg_stat_bgwriter"},
+		},
+		Metrics: []*Column{
+			{Name: "checkpoint_write_time", Usage: COUNTER, Unit: "ms"},
+			{Name: "buffers_checkpoint", Usage: COUNTER, Unit: "8kB"},
+			{Name: "flush_time", Usage: DURATION},
+		},
+	}
+	s, mock := newMockServer(t, queryInstance)
+	expectTxQuery(mock, "SELECT").WillReturnRows(
+		sqlmock.NewRows([]string{"checkpoint_write_time", "buffers_checkpoint", "flush_time"}).AddRow(1500, 2, 250))
+	metrics, errs, err := s.queryMetric("pg_stat_bgwriter", queryInstance)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []error{}, errs)
+	assert.Len(t, metrics, 3)
+	for _, m := range metrics {
+		pb := &dto.Metric{}
+		assert.NoError(t, m.Write(pb))
+		switch {
+		case strings.Contains(m.Desc().String(), `"pg_stat_bgwriter_checkpoint_write_time_seconds"`):
+			assert.Equal(t, 1.5, pb.GetCounter().GetValue())
+		case strings.Contains(m.Desc().String(), `"pg_stat_bgwriter_buffers_checkpoint_bytes"`):
+			assert.Equal(t, float64(16384), pb.GetCounter().GetValue())
+		case strings.Contains(m.Desc().String(), `"pg_stat_bgwriter_flush_time_seconds"`):
+			assert.Equal(t, 0.25, pb.GetGauge().GetValue())
+		default:
+			t.Errorf("unexpected metric %s", m.Desc())
+		}
+	}
+
+	queryInstance.Metrics[1].Unit = "pages"
+	assert.Error(t, queryInstance.Check())
+}
+
+func Test_Server_queryMetric_rename(t *testing.T) {
+	queryInstance := &QueryInstance{
+		Name:         "pg_lock",
+		MetricPrefix: "og_locks",
+		Queries: []*Query{
+			{SQL: "SELECT datname, mode, count FROM pg_locks"},
+		},
+		Metrics: []*Column{
+			{Name: "datname", Usage: LABEL, Rename: "database"},
+			{Name: "mode", Usage: LABEL},
+			{Name: "count", Usage: GAUGE, Rename: "total"},
+		},
+	}
+	s, mock := newMockServer(t, queryInstance)
+	assert.Equal(t, []string{"datname", "mode"}, queryInstance.LabelNames)
+	assert.Equal(t, []string{"database", "mode"}, queryInstance.LabelKeys)
+	expectTxQuery(mock, "SELECT").WillReturnRows(
+		sqlmock.NewRows([]string{"datname", "mode", "count"}).AddRow("postgres", "AccessShareLock", 4))
+	metrics, errs, err := s.queryMetric("pg_lock", queryInstance)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []error{}, errs)
+	assert.Len(t, metrics, 1)
+	assert.Contains(t, metrics[0].Desc().String(), `fqName: "og_locks_total"`)
+	assert.Contains(t, metrics[0].Desc().String(), `variableLabels: [database mode]`)
+	pb := &dto.Metric{}
+	assert.NoError(t, metrics[0].Write(pb))
+	assert.Equal(t, "database", pb.GetLabel()[0].GetName())
+	assert.Equal(t, "postgres", pb.GetLabel()[0].GetValue())
+
+	queryInstance.Metrics[2].Rename = "mode"
+	assert.Error(t, queryInstance.Check())
+	queryInstance.Metrics[2].Rename = "bad-name"
+	assert.Error(t, queryInstance.Check())
+	queryInstance.Metrics[2].Rename = ""
+	queryInstance.MetricPrefix = "og-locks"
+	assert.Error(t, queryInstance.Check())
+}
+
+func Test_Server_queryMetric_info(t *testing.T) {
+	queryInstance := &QueryInstance{
+		Name: "og_directory",
+		Info: true,
+		Queries: []*Query{
+			{SQL: "SELECT name AS dir_name, setting AS dir_set FROM pg_settings"},
+		},
+		Metrics: []*Column{
+			{Name: "dir_name", Usage: LABEL},
+			{Name: "dir_set", Usage: LABEL},
+		},
+	}
+	s, mock := newMockServer(t, queryInstance)
+	expectTxQuery(mock, "SELECT").WillReturnRows(
+		sqlmock.NewRows([]string{"dir_name", "dir_set"}).FromCSVString(`data_directory,/opt/data
+log_directory,pg_log`))
+	metrics, errs, err := s.queryMetric("og_directory", queryInstance)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []error{}, errs)
+	assert.Len(t, metrics, 2)
+	for _, m := range metrics {
+		assert.Contains(t, m.Desc().String(), `fqName: "og_directory_info"`)
+		pb := &dto.Metric{}
+		assert.NoError(t, m.Write(pb))
+		assert.Equal(t, float64(1), pb.GetGauge().GetValue())
+	}
+
+	queryInstance.Metrics[0].Usage = GAUGE
+	queryInstance.Metrics[1].Usage = GAUGE
+	assert.Error(t, queryInstance.Check())
+}
+
+func Test_Server_queryMetric_pivot(t *testing.T) {
+	queryInstance := &QueryInstance{
+		Name:        "og_instance_time",
+		KeyColumn:   "stat_name",
+		ValueColumn: "value",
+		Queries: []*Query{
+			{SQL: "SELECT node_name, stat_name, value FROM dbe_perf.global_instance_time"},
+		},
+		Metrics: []*Column{
+			{Name: "node_name", Usage: LABEL},
+			{Name: "value", Usage: COUNTER, Unit: "us"},
+		},
+	}
+	s, mock := newMockServer(t, queryInstance)
+	assert.Empty(t, queryInstance.MetricNames)
+	expectTxQuery(mock, "SELECT").WillReturnRows(
+		sqlmock.NewRows([]string{"node_name", "stat_name", "value"}).FromCSVString(`dn_6001,DB_TIME,2000000
+dn_6001,CPU_TIME,1500000
+dn_6001,CPU_TIME,1500000
+dn_6001,,1`))
+	metrics, errs, err := s.queryMetric("og_instance_time", queryInstance)
+	assert.NoError(t, err)
+	assert.Len(t, errs, 2)
+	assert.Len(t, metrics, 2)
+	assert.Contains(t, metrics[0].Desc().String(), `fqName: "og_instance_time_db_time_seconds"`)
+	pb := &dto.Metric{}
+	assert.NoError(t, metrics[0].Write(pb))
+	assert.Equal(t, float64(2), pb.GetCounter().GetValue())
+	assert.Contains(t, metrics[1].Desc().String(), `fqName: "og_instance_time_cpu_time_seconds"`)
+
+	queryInstance.ValueColumn = ""
+	assert.Error(t, queryInstance.Check())
+	queryInstance.ValueColumn = "node_name"
+	assert.Error(t, queryInstance.Check())
+}
+
+func Test_Server_queryMetric_delta(t *testing.T) {
+	queryInstance := &QueryInstance{
+		Name: "pg_database",
+		Queries: []*Query{
+			{SQL: "SELECT datname, xact_commit, blks_read FROM pg_stat_database"},
+		},
+		Metrics: []*Column{
+			{Name: "datname", Usage: LABEL},
+			{Name: "xact_commit", Usage: DELTA, Raw: true},
+			{Name: "blks_read", Usage: RATE},
+		},
+	}
+	s, mock := newMockServer(t, queryInstance)
+	columns := []string{"datname", "xact_commit", "blks_read"}
+	expectTxQuery(mock, "SELECT").WillReturnRows(sqlmock.NewRows(columns).AddRow("postgres", 100, 1000))
+	expectTxQuery(mock, "SELECT").WillReturnRows(sqlmock.NewRows(columns).AddRow("postgres", 130, 1000))
+
+	metrics, errs, err := s.queryMetric("pg_database", queryInstance)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []error{}, errs)
+	assert.Len(t, metrics, 1, "only raw counter on first scrape")
+	assert.Contains(t, metrics[0].Desc().String(), `fqName: "pg_database_xact_commit"`)
+
+	metrics, errs, err = s.queryMetric("pg_database", queryInstance)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []error{}, errs)
+	assert.Len(t, metrics, 3)
+	for _, m := range metrics {
+		pb := &dto.Metric{}
+		assert.NoError(t, m.Write(pb))
+		switch {
+		case strings.Contains(m.Desc().String(), `"pg_database_xact_commit_delta"`):
+			assert.Equal(t, float64(30), pb.GetGauge().GetValue())
+		case strings.Contains(m.Desc().String(), `"pg_database_blks_read_rate"`):
+			assert.Equal(t, float64(0), pb.GetGauge().GetValue())
+		case strings.Contains(m.Desc().String(), `"pg_database_xact_commit"`):
+			assert.Equal(t, float64(130), pb.GetCounter().GetValue())
+		default:
+			t.Errorf("unexpected metric %s", m.Desc())
+		}
+	}
+}
+
+func Test_Server_queryMetric_concurrent(t *testing.T) {
+	queryInstance := &QueryInstance{
+		Name: "pg_database",
+		Queries: []*Query{
+			{SQL: "SELECT datname, xact_commit, numbackends FROM pg_stat_database"},
+		},
+		Metrics: []*Column{
+			{Name: "datname", Usage: LABEL},
+			{Name: "xact_commit", Usage: DELTA, Raw: true},
+			{Name: "numbackends", Usage: GAUGE},
+		},
+	}
+	const scrapes = 20
+	columns := []string{"datname", "xact_commit", "numbackends"}
+	servers := make([]*Server, 2)
+	for i := range servers {
+		s, mock := newMockServer(t, queryInstance)
+		s.labels = prometheus.Labels{"server": fmt.Sprintf("localhost:%d", 5432+i)}
+		for n := 0; n < scrapes; n++ {
+			expectTxQuery(mock, "SELECT").WillReturnRows(sqlmock.NewRows(columns).AddRow("postgres", (i+1)*n, 1))
+		}
+		servers[i] = s
+	}
+	var wg sync.WaitGroup
+	for i, s := range servers {
+		wg.Add(1)
+		go func(i int, s *Server) {
+			defer wg.Done()
+			for n := 0; n < scrapes; n++ {
+				metrics, _, err := s.queryMetric("pg_database", queryInstance)
+				assert.NoError(t, err)
+				for _, m := range metrics {
+					assert.Contains(t, m.Desc().String(), fmt.Sprintf(`server="localhost:%d"`, 5432+i))
+					pb := &dto.Metric{}
+					assert.NoError(t, m.Write(pb))
+					if n > 0 && strings.Contains(m.Desc().String(), `"pg_database_xact_commit_delta"`) {
+						assert.Equal(t, float64(i+1), pb.GetGauge().GetValue())
+					}
+				}
+			}
+		}(i, s)
+	}
+	wg.Wait()
+}
+
+func Test_Server_queryMetric_maxSeries(t *testing.T) {
+	queryInstance := &QueryInstance{
+		Name:       "og_tables_size",
+		MaxSeries:  4,
+		SortColumn: "size",
+		Queries: []*Query{
+			{SQL: "SELECT relname, size, rows FROM pg_class"},
+		},
+		Metrics: []*Column{
+			{Name: "relname", Usage: LABEL},
+			{Name: "size", Usage: GAUGE},
+			{Name: "rows", Usage: GAUGE},
+		},
+	}
+	s, mock := newMockServer(t, queryInstance)
+	assert.Equal(t, sortOrderDesc, queryInstance.SortOrder)
+	expectTxQuery(mock, "SELECT").WillReturnRows(
+		sqlmock.NewRows([]string{"relname", "size", "rows"}).FromCSVString(`t1,10,1
+t2,300,1
+t3,20,1
+t4,1000,1`))
+	metrics, errs, err := s.queryMetric("og_tables_size", queryInstance)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []error{}, errs)
+	assert.Len(t, metrics, 4)
+	for _, m := range metrics {
+		pb := &dto.Metric{}
+		assert.NoError(t, m.Write(pb))
+		assert.Contains(t, []string{"t4", "t2"}, pb.GetLabel()[0].GetValue())
+	}
+
+	ch := make(chan prometheus.Metric, 20)
+	s.collectQueryStats(ch)
+	close(ch)
+	stat := <-ch
+	assert.Contains(t, stat.Desc().String(), `fqName: "pg_exporter_query_dropped_series"`)
+	pb := &dto.Metric{}
+	assert.NoError(t, stat.Write(pb))
+	assert.Equal(t, float64(4), pb.GetGauge().GetValue())
+
+	queryInstance.SortOrder = "random"
+	assert.Error(t, queryInstance.Check())
+	queryInstance.SortOrder = ""
+	queryInstance.MaxSeries = -1
+	assert.Error(t, queryInstance.Check())
+}
+
+func Test_sortRows(t *testing.T) {
+	rows := [][]interface{}{{"b", int64(2)}, {"a", nil}, {"c", []byte("10")}, {"d", int64(1)}}
+	sortRows(rows, 1, true)
+	assert.Equal(t, []interface{}{"d", "b", "c", "a"}, []interface{}{rows[0][0], rows[1][0], rows[2][0], rows[3][0]})
+	sortRows(rows, 1, false)
+	assert.Equal(t, []interface{}{"c", "b", "d", "a"}, []interface{}{rows[0][0], rows[1][0], rows[2][0], rows[3][0]})
+	sortRows(rows, 0, true)
+	assert.Equal(t, []interface{}{"a", "b", "c", "d"}, []interface{}{rows[0][0], rows[1][0], rows[2][0], rows[3][0]})
+}
+
+func Test_Server_queryMetric_policy(t *testing.T) {
+	queryInstance := &QueryInstance{
+		Name: "pg_stat_replication",
+		Queries: []*Query{
+			{SQL: "SELECT application_name, lag, location FROM pg_stat_replication"},
+		},
+		Metrics: []*Column{
+			{Name: "application_name", Usage: LABEL},
+			{Name: "lag", Usage: GAUGE, OnNull: "skip"},
+			{Name: "location", Usage: GAUGE, OnError: "fail"},
+		},
+	}
+	s, mock := newMockServer(t, queryInstance)
+	columns := []string{"application_name", "lag", "location"}
+	expectTxQuery(mock, "SELECT").WillReturnRows(sqlmock.NewRows(columns).AddRow("standby1", nil, 1))
+	expectTxQuery(mock, "SELECT").WillReturnRows(sqlmock.NewRows(columns).AddRow("standby1", 1, "0/3000060"))
+
+	metrics, errs, err := s.queryMetric("pg_stat_replication", queryInstance)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []error{}, errs)
+	assert.Len(t, metrics, 1)
+
+	metrics, _, err = s.queryMetric("pg_stat_replication", queryInstance)
+	assert.Error(t, err)
+	assert.Empty(t, metrics)
+}
+
+func Test_dbToLSN(t *testing.T) {
+	tests := []struct {
+		name  string
+		t     interface{}
+		want  float64
+		want1 bool
+	}{
+		{name: "string", t: "0/3000060", want: 0x3000060, want1: true},
+		{name: "[]byte", t: []byte("1/331980B8"), want: 0x1331980B8, want1: true},
+		{name: "int64", t: int64(1024), want: 1024, want1: true},
+		{name: "invalid", t: "3000060", want1: false},
+		{name: "invalid_hex", t: "0/XYZ", want1: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, got1 := dbToLSN(tt.t)
+			assert.Equal(t, tt.want1, got1)
+			if got1 {
+				assert.Equal(t, tt.want, got)
+			}
+		})
+	}
+}
+
+func Test_Server_queryMetric_lsn(t *testing.T) {
+	queryInstance := &QueryInstance{
+		Name: "pg_stat_replication",
+		Queries: []*Query{
+			{SQL: "SELECT application_name, sender_sent_location, receiver_replay_location FROM pg_stat_replication"},
+		},
+		Metrics: []*Column{
+			{Name: "application_name", Usage: LABEL},
+			{Name: "sender_sent_location", Usage: LSN},
+			{Name: "receiver_replay_location", Usage: LSN, LagFrom: "sender_sent_location", Rename: "replay_lag_bytes"},
+		},
+	}
+	s, mock := newMockServer(t, queryInstance)
+	expectTxQuery(mock, "SELECT").WillReturnRows(
+		sqlmock.NewRows([]string{"application_name", "sender_sent_location", "receiver_replay_location"}).AddRow("standby1", "1/10", "0/FFFFFFF0"))
+	metrics, errs, err := s.queryMetric("pg_stat_replication", queryInstance)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []error{}, errs)
+	assert.Len(t, metrics, 2)
+	for _, m := range metrics {
+		pb := &dto.Metric{}
+		assert.NoError(t, m.Write(pb))
+		switch {
+		case strings.Contains(m.Desc().String(), `"pg_stat_replication_sender_sent_location"`):
+			assert.Equal(t, float64(0x100000010), pb.GetGauge().GetValue())
+		case strings.Contains(m.Desc().String(), `"pg_stat_replication_replay_lag_bytes"`):
+			assert.Equal(t, float64(0x20), pb.GetGauge().GetValue())
+		default:
+			t.Errorf("unexpected metric %s", m.Desc())
+		}
+	}
+
+	queryInstance.Metrics[1].LagFrom = "receiver_replay_location"
+	queryInstance.Metrics[1].Usage = GAUGE
+	assert.Error(t, queryInstance.Check())
+}
+
+func Test_dbToTimestamp(t *testing.T) {
+	tests := []struct {
+		name  string
+		t     interface{}
+		want  float64
+		want1 bool
+	}{
+		{name: "time.Time", t: time.Unix(123456790, 500000000), want: 123456790.5, want1: true},
+		{name: "[]byte", t: []byte("2021-01-06 14:45:59.5+08"), want: 1609915559.5, want1: true},
+		{name: "string_no_tz", t: "2021-01-06 06:45:59", want: 1609915559, want1: true},
+		{name: "int64", t: int64(100), want: 100, want1: true},
+		{name: "invalid", t: "yesterday", want1: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, got1 := dbToTimestamp(tt.t)
+			assert.Equal(t, tt.want1, got1)
+			if got1 {
+				assert.InDelta(t, tt.want, got, 1e-6)
+			}
+		})
+	}
+}
+
+func Test_dbToInterval(t *testing.T) {
+	tests := []struct {
+		name  string
+		t     interface{}
+		want  float64
+		want1 bool
+	}{
+		{name: "time", t: "01:02:03.5", want: 3723.5, want1: true},
+		{name: "negative_time", t: []byte("-00:00:01"), want: -1, want1: true},
+		{name: "days", t: "3 days", want: 259200, want1: true},
+		{name: "mixed", t: "1 year 2 mons 3 days 04:05:06", want: 31557600 + 2*2592000 + 3*86400 + 4*3600 + 5*60 + 6, want1: true},
+		{name: "verbose", t: "@ 3 mins 2.5 secs ago", want: -182.5, want1: true},
+		{name: "float64", t: float64(1.5), want: 1.5, want1: true},
+		{name: "unknown_unit", t: "3 fortnights", want1: false},
+		{name: "invalid", t: "1:2:3:4", want1: false},
+		{name: "empty", t: "", want1: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, got1 := dbToInterval(tt.t)
+			assert.Equal(t, tt.want1, got1)
+			if got1 {
+				assert.InDelta(t, tt.want, got, 1e-6)
+			}
+		})
+	}
+}
+
+func Test_Server_queryMetric_age(t *testing.T) {
+	queryInstance := &QueryInstance{
+		Name: "pg_stat_replication",
+		Queries: []*Query{
+			{SQL: "SELECT application_name, backend_start, write_lag FROM pg_stat_replication"},
+		},
+		Metrics: []*Column{
+			{Name: "application_name", Usage: LABEL},
+			{Name: "backend_start", Usage: AGE},
+			{Name: "write_lag", Usage: INTERVAL, OnNull: "0"},
+		},
+	}
+	s, mock := newMockServer(t, queryInstance)
+	s.setClockOffset(time.Hour)
+	expectTxQuery(mock, "SELECT").WillReturnRows(
+		sqlmock.NewRows([]string{"application_name", "backend_start", "write_lag"}).AddRow("standby1", time.Now().Add(time.Hour-time.Minute), nil))
+	metrics, errs, err := s.queryMetric("pg_stat_replication", queryInstance)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []error{}, errs)
+	assert.Len(t, metrics, 2)
+	for _, m := range metrics {
+		pb := &dto.Metric{}
+		assert.NoError(t, m.Write(pb))
+		switch {
+		case strings.Contains(m.Desc().String(), `"pg_stat_replication_backend_start_age_seconds"`):
+			assert.InDelta(t, 60, pb.GetGauge().GetValue(), 5)
+		case strings.Contains(m.Desc().String(), `"pg_stat_replication_write_lag_seconds"`):
+			assert.Equal(t, float64(0), pb.GetGauge().GetValue())
+		default:
+			t.Errorf("unexpected metric %s", m.Desc())
+		}
+	}
+}
+
+func Test_Server_queryMetric_stateset(t *testing.T) {
+	queryInstance := &QueryInstance{
+		Name: "pg_stat_replication",
+		Queries: []*Query{
+			{SQL: "SELECT application_name, sync_state FROM pg_stat_replication"},
+		},
+		Metrics: []*Column{
+			{Name: "application_name", Usage: LABEL},
+			{Name: "sync_state", Usage: STATESET, States: []string{"Async", "Sync", "Potential"}},
+		},
+	}
+	s, mock := newMockServer(t, queryInstance)
+	expectTxQuery(mock, "SELECT").WillReturnRows(
+		sqlmock.NewRows([]string{"application_name", "sync_state"}).AddRow("standby1", "sync"))
+	metrics, errs, err := s.queryMetric("pg_stat_replication", queryInstance)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []error{}, errs)
+	assert.Len(t, metrics, 3)
+	values := make(map[string]float64)
+	for _, m := range metrics {
+		assert.Contains(t, m.Desc().String(), `fqName: "pg_stat_replication_sync_state"`)
+		pb := &dto.Metric{}
+		assert.NoError(t, m.Write(pb))
+		for _, l := range pb.GetLabel() {
+			if l.GetName() == "sync_state" {
+				values[l.GetValue()] = pb.GetGauge().GetValue()
+			}
+		}
+	}
+	assert.Equal(t, map[string]float64{"Async": 0, "Sync": 1, "Potential": 0}, values)
+
+	queryInstance.Metrics[1].States = []string{"Sync", "sync"}
+	assert.Error(t, queryInstance.Check())
+	queryInstance.Metrics[1].States = nil
+	assert.Error(t, queryInstance.Check())
+}
+
+func Test_Server_queryMetrics_tags(t *testing.T) {
+	queryInstance := &QueryInstance{
+		Name: "pg_lock",
+		Queries: []*Query{
+			{SQL: "SELECT datname, count FROM pg_locks", Tags: []string{"deep"}},
+		},
+		Metrics: []*Column{
+			{Name: "datname", Usage: LABEL},
+			{Name: "count", Usage: GAUGE},
+		},
+	}
+	s, mock := newMockServer(t, queryInstance)
+	ch := make(chan prometheus.Metric, 10)
+	assert.Empty(t, s.queryMetrics(ch))
+	assert.Len(t, ch, 0)
+
+	s.tags = []string{"deep"}
+	expectTxQuery(mock, "SELECT").WillReturnRows(sqlmock.NewRows([]string{"datname", "count"}).AddRow("postgres", 1))
+	assert.Empty(t, s.queryMetrics(ch))
+	assert.Len(t, ch, 1)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func Test_Server_QueryRole(t *testing.T) {
+	queryInstance := &QueryInstance{
+		Name: "pg_stat_replication",
+		Role: rolePrimary,
+		Queries: []*Query{
+			{SQL: "SELECT application_name, count FROM pg_stat_replication"},
+		},
+		Metrics: []*Column{
+			{Name: "application_name", Usage: LABEL},
+			{Name: "count", Usage: GAUGE},
+		},
+	}
+	s, mock := newMockServer(t, queryInstance)
+	ch := make(chan prometheus.Metric, 10)
+
+	mock.ExpectQuery("pg_is_in_recovery").WillReturnRows(sqlmock.NewRows([]string{"pg_is_in_recovery"}).AddRow(true))
+	assert.NoError(t, s.QueryRole())
+	assert.Equal(t, roleStandby, s.Role())
+	assert.Empty(t, s.queryMetrics(ch))
+	assert.Len(t, ch, 0)
+
+	mock.ExpectQuery("pg_is_in_recovery").WillReturnRows(sqlmock.NewRows([]string{"pg_is_in_recovery"}).AddRow(false))
+	assert.NoError(t, s.QueryRole())
+	assert.Equal(t, rolePrimary, s.Role())
+	expectTxQuery(mock, "SELECT").WillReturnRows(sqlmock.NewRows([]string{"application_name", "count"}).AddRow("standby1", 1))
+	assert.Empty(t, s.queryMetrics(ch))
+	assert.Len(t, ch, 1)
+
+	mock.ExpectQuery("pg_is_in_recovery").WillReturnError(fmt.Errorf("connection refused"))
+	assert.Error(t, s.QueryRole())
+	assert.Equal(t, "", s.Role())
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func Test_Server_queryMetrics_predicate(t *testing.T) {
+	queryInstance := &QueryInstance{
+		Name:      "og_sql_history",
+		Predicate: "SELECT has_table_privilege('dbe_perf.statement', 'select')",
+		TTL:       60,
+		Queries: []*Query{
+			{SQL: "SELECT unique_sql_id, n_calls FROM dbe_perf.statement"},
+		},
+		Metrics: []*Column{
+			{Name: "unique_sql_id", Usage: LABEL},
+			{Name: "n_calls", Usage: GAUGE},
+		},
+	}
+	s, mock := newMockServer(t, queryInstance)
+	skipped := func() float64 {
+		ch := make(chan prometheus.Metric, 20)
+		s.collectQueryStats(ch)
+		close(ch)
+		for m := range ch {
+			if strings.Contains(m.Desc().String(), `fqName: "pg_exporter_query_skipped"`) {
+				pb := &dto.Metric{}
+				assert.NoError(t, m.Write(pb))
+				return pb.GetGauge().GetValue()
+			}
+		}
+		return -1
+	}
+	ch := make(chan prometheus.Metric, 10)
+
+	// predicate false, skipped and cached with ttl
+	expectTxQuery(mock, "has_table_privilege").WillReturnRows(sqlmock.NewRows([]string{"has_table_privilege"}).AddRow(false))
+	assert.Empty(t, s.queryMetrics(ch))
+	assert.Empty(t, s.queryMetrics(ch))
+	assert.Len(t, ch, 0)
+	assert.Equal(t, float64(1), skipped())
+
+	// cache expired, predicate true
+	s.metricCache = make(map[string]cachedMetrics)
+	mock.ExpectBegin()
+	mock.ExpectExec("SET LOCAL statement_timeout").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("has_table_privilege").WillReturnRows(sqlmock.NewRows([]string{"has_table_privilege"}).AddRow(true))
+	mock.ExpectQuery("dbe_perf.statement").WillReturnRows(sqlmock.NewRows([]string{"unique_sql_id", "n_calls"}).AddRow("1", 10))
+	mock.ExpectRollback()
+	assert.Empty(t, s.queryMetrics(ch))
+	assert.Len(t, ch, 1)
+	assert.Equal(t, float64(0), skipped())
+
+	// predicate error is reported
+	s.metricCache = make(map[string]cachedMetrics)
+	expectTxQuery(mock, "has_table_privilege").WillReturnError(fmt.Errorf("permission denied"))
+	assert.Len(t, s.queryMetrics(ch), 1)
+
+	// predicate runs under the query timeout
+	s.metricCache = make(map[string]cachedMetrics)
+	expectTxQuery(mock, "has_table_privilege").WillReturnError(&pq.Error{Code: "57014", Message: "canceling statement due to statement timeout"})
+	assert.IsType(t, &ErrorQueryTimeout{}, s.queryMetrics(ch)["og_sql_history"])
+
+	// predicate on a view missing on this instance skips the query
+	s.metricCache = make(map[string]cachedMetrics)
+	expectTxQuery(mock, "has_table_privilege").WillReturnError(&pq.Error{Code: "42P01", Message: `relation "dbe_perf.statement" does not exist`})
+	assert.Empty(t, s.queryMetrics(ch))
+	assert.Equal(t, float64(1), skipped())
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func Test_Server_queryMetrics_scope(t *testing.T) {
+	queryInstance := &QueryInstance{
+		Name:  "pg_lock",
+		Scope: scopeCluster,
+		Queries: []*Query{
+			{SQL: "SELECT datname, count FROM pg_locks"},
+		},
+		Metrics: []*Column{
+			{Name: "datname", Usage: LABEL},
+			{Name: "count", Usage: GAUGE},
+		},
+	}
+	s, mock := newMockServer(t, queryInstance)
+	s.database = "app"
+	ch := make(chan prometheus.Metric, 10)
+	assert.Empty(t, s.queryMetrics(ch))
+	assert.Len(t, ch, 0)
+
+	s.setMaster()
+	expectTxQuery(mock, "SELECT").WillReturnRows(sqlmock.NewRows([]string{"datname", "count"}).AddRow("postgres", 1))
+	assert.Empty(t, s.queryMetrics(ch))
+	assert.Len(t, ch, 1)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func Test_Server_queryMetric_params(t *testing.T) {
+	queryInstance := &QueryInstance{
+		Name: "og_need_indexes",
+		Queries: []*Query{
+			{SQL: "SELECT relname, seq_scan FROM pg_stat_user_tables WHERE pg_table_size(relid) > $1 LIMIT $2", Params: []string{"1073741824", "10"}},
+		},
+		Metrics: []*Column{
+			{Name: "relname", Usage: LABEL},
+			{Name: "seq_scan", Usage: COUNTER},
+		},
+	}
+	s, mock := newMockServer(t, queryInstance)
+	expectTxQuery(mock, "SELECT").WithArgs("1073741824", "10").WillReturnRows(sqlmock.NewRows([]string{"relname", "seq_scan"}).AddRow("t1", 5))
+	metrics, errs, err := s.queryMetric("og_need_indexes", queryInstance)
+	assert.NoError(t, err)
+	assert.Empty(t, errs)
+	assert.Len(t, metrics, 1)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestServers_GetServer_unreachable(t *testing.T) {
+	delay := connectRetryDelay
+	connectRetryDelay = time.Millisecond
+	defer func() { connectRetryDelay = delay }()
+
+	servers := NewServers()
+	dsn := "host=127.0.0.1 port=1 user=test dbname=postgres sslmode=disable connect_timeout=1"
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			server, err := servers.GetServer(dsn)
+			assert.Error(t, err)
+			assert.Nil(t, server)
+		}()
+	}
+	wg.Wait()
+	assert.Empty(t, servers.servers)
+}
+
+// expectTxQuery expects a query executed by queryMetric, in a read only transaction with timeouts
+func expectTxQuery(mock sqlmock.Sqlmock, expectedSQL string) *sqlmock.ExpectedQuery {
+	mock.ExpectBegin()
+	mock.ExpectExec("SET LOCAL statement_timeout").WillReturnResult(sqlmock.NewResult(0, 0))
+	query := mock.ExpectQuery(expectedSQL)
+	mock.ExpectRollback()
+	return query
+}
+
+// newMockServer checks queryInstance and returns a server running it on a mocked database
+func newMockServer(t *testing.T, queryInstance *QueryInstance) (*Server, sqlmock.Sqlmock) {
+	t.Helper()
+	if err := queryInstance.Check(); err != nil {
+		t.Fatal(err)
+	}
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{
+		db:               db,
+		labels:           prometheus.Labels{"server": "localhost:5432"},
+		namespace:        "pg",
+		queryInstanceMap: map[string]*QueryInstance{queryInstance.Name: queryInstance},
+		metricCache:      make(map[string]cachedMetrics),
+	}
+	return s, mock
+}
@@ -103,53 +103,58 @@ func (s *pgSetting) normaliseUnit() (val float64, unit string, err error) {
 	}
 
 	// Units defined in: https://www.postgresql.org/docs/current/static/config-setting.html
-	switch s.unit {
-	case "":
+	if s.unit == "" {
 		return
-	case "ms", "s", "min", "h", "d":
-		unit = "seconds"
-	case "B", "kB", "MB", "GB", "TB", "8kB", "16kB", "32kB", "16MB", "32MB", "64MB":
-		unit = "bytes"
-	default:
+	}
+	if _, ok := unitConversions[s.unit]; !ok {
 		err = fmt.Errorf("Unknown unit for runtime variable: %q ", s.unit)
 		return
 	}
 
 	// -1 is special, don't modify the value
 	if val == -1 {
+		unit = unitConversions[s.unit].base
 		return
 	}
 
-	switch s.unit {
-	case "ms":
-		val /= 1000
-	case "min":
-		val *= 60
-	case "h":
-		val *= 60 * 60
-	case "d":
-		val *= 60 * 60 * 24
-	case "kB":
-		val *= math.Pow(2, 10)
-	case "MB":
-		val *= math.Pow(2, 20)
-	case "GB":
-		val *= math.Pow(2, 30)
-	case "TB":
-		val *= math.Pow(2, 40)
-	case "8kB":
-		val *= math.Pow(2, 13)
-	case "16kB":
-		val *= math.Pow(2, 14)
-	case "32kB":
-		val *= math.Pow(2, 15)
-	case "16MB":
-		val *= math.Pow(2, 24)
-	case "32MB":
-		val *= math.Pow(2, 25)
-	case "64MB":
-		val *= math.Pow(2, 26)
-	}
-
+	val, unit, err = normaliseUnit(val, s.unit)
 	return
 }
+
+// unitConversions map OpenGauss units to prometheus base units and the factors to reach them
+var unitConversions = map[string]struct {
+	base     string
+	mul, div float64
+}{
+	"us":    {"seconds", 1, 1e6},
+	"µs":    {"seconds", 1, 1e6},
+	"ms":    {"seconds", 1, 1e3},
+	"s":     {"seconds", 1, 1},
+	"min":   {"seconds", 60, 1},
+	"h":     {"seconds", 60 * 60, 1},
+	"d":     {"seconds", 60 * 60 * 24, 1},
+	"B":     {"bytes", 1, 1},
+	"bytes": {"bytes", 1, 1},
+	"kB":    {"bytes", math.Pow(2, 10), 1},
+	"MB":    {"bytes", math.Pow(2, 20), 1},
+	"GB":    {"bytes", math.Pow(2, 30), 1},
+	"TB":    {"bytes", math.Pow(2, 40), 1},
+	"8kB":   {"bytes", math.Pow(2, 13), 1},
+	"16kB":  {"bytes", math.Pow(2, 14), 1},
+	"32kB":  {"bytes", math.Pow(2, 15), 1},
+	"16MB":  {"bytes", math.Pow(2, 24), 1},
+	"32MB":  {"bytes", math.Pow(2, 25), 1},
+	"64MB":  {"bytes", math.Pow(2, 26), 1},
+}
+
+// normaliseUnit convert value in given unit into prometheus base unit (seconds or bytes)
+func normaliseUnit(val float64, unit string) (float64, string, error) {
+	if unit == "" {
+		return val, "", nil
+	}
+	conv, ok := unitConversions[unit]
+	if !ok {
+		return val, "", fmt.Errorf("unknown unit %q", unit)
+	}
+	return val * conv.mul / conv.div, conv.base, nil
+}
@@ -0,0 +1,58 @@
+// Copyright © 2020 Bin Liu <bin.liu@enmotech.com>
+
+package exporter
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func Test_normaliseUnit(t *testing.T) {
+	tests := []struct {
+		name     string
+		val      float64
+		unit     string
+		want     float64
+		wantUnit string
+		wantErr  bool
+	}{
+		{name: "none", val: 12, unit: "", want: 12, wantUnit: ""},
+		{name: "us", val: 1500000, unit: "us", want: 1.5, wantUnit: "seconds"},
+		{name: "ms", val: 200, unit: "ms", want: 0.2, wantUnit: "seconds"},
+		{name: "min", val: 2, unit: "min", want: 120, wantUnit: "seconds"},
+		{name: "8kB", val: 2, unit: "8kB", want: 16384, wantUnit: "bytes"},
+		{name: "unknown", val: 2, unit: "pages", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, gotUnit, err := normaliseUnit(tt.val, tt.unit)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("normaliseUnit() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if tt.wantErr {
+				return
+			}
+			assert.Equal(t, tt.want, got)
+			assert.Equal(t, tt.wantUnit, gotUnit)
+		})
+	}
+}
+
+func Test_pgSetting_normaliseUnit(t *testing.T) {
+	s := &pgSetting{name: "statement_timeout", setting: "-1", unit: "ms", varType: "integer"}
+	val, unit, err := s.normaliseUnit()
+	assert.NoError(t, err)
+	assert.Equal(t, float64(-1), val)
+	assert.Equal(t, "seconds", unit)
+
+	s = &pgSetting{name: "shared_buffers", setting: "16384", unit: "8kB", varType: "integer"}
+	val, unit, err = s.normaliseUnit()
+	assert.NoError(t, err)
+	assert.Equal(t, float64(134217728), val)
+	assert.Equal(t, "bytes", unit)
+
+	s = &pgSetting{name: "x", setting: "1", unit: "XB", varType: "integer"}
+	_, _, err = s.normaliseUnit()
+	assert.Error(t, err)
+}
@@ -0,0 +1,167 @@
+// Copyright © 2020 Bin Liu <bin.liu@enmotech.com>
+
+package exporter
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"sort"
+	"time"
+)
+
+// queryStat holds execution statistics of a query instance on a server
+type queryStat struct {
+	droppedSeries int            // series dropped by max_series on last execution
+	skipped       bool           // predicate not satisfied on last check
+	predicate     bool           // query has a predicate, skipped is meaningful
+	errors        map[string]int // number of errors by error class
+	executions    int            // number of executions on database
+	cacheHits     int            // number of scrapes served from cached metrics
+	duration      time.Duration  // duration of last execution
+	rows          int            // rows returned by last execution
+	series        int            // series emitted by last execution, a histogram counts its buckets, sum and count
+	lastSuccess   time.Time      // end of last successful execution
+}
+
+// stat returns statistics of a query, must be called with statsMtx held
+func (s *Server) stat(metricName string) *queryStat {
+	if s.queryStats == nil {
+		s.queryStats = make(map[string]*queryStat)
+	}
+	stat, ok := s.queryStats[metricName]
+	if !ok {
+		stat = &queryStat{}
+		s.queryStats[metricName] = stat
+	}
+	return stat
+}
+
+func (s *Server) setDroppedSeries(metricName string, dropped int) {
+	s.statsMtx.Lock()
+	defer s.statsMtx.Unlock()
+	s.stat(metricName).droppedSeries = dropped
+}
+
+func (s *Server) setSkipped(metricName string, skipped bool) {
+	s.statsMtx.Lock()
+	defer s.statsMtx.Unlock()
+	stat := s.stat(metricName)
+	stat.predicate, stat.skipped = true, skipped
+}
+
+func (s *Server) setRows(metricName string, rows int) {
+	s.statsMtx.Lock()
+	defer s.statsMtx.Unlock()
+	s.stat(metricName).rows = rows
+}
+
+// observeExecution records an execution of query on database, fatal error or every non-fatal error
+// is counted by its class.
+func (s *Server) observeExecution(metricName string, result cachedMetrics, duration time.Duration) {
+	s.statsMtx.Lock()
+	defer s.statsMtx.Unlock()
+	stat := s.stat(metricName)
+	stat.executions++
+	stat.duration = duration
+	stat.series = countSeries(result.metrics)
+	if stat.errors == nil {
+		stat.errors = make(map[string]int)
+	}
+	if result.err != nil {
+		stat.rows = 0
+		stat.errors[classifyError(result.err)]++
+		return
+	}
+	for _, err := range result.nonFatalErrors {
+		stat.errors[classifyError(err)]++
+	}
+	stat.lastSuccess = time.Now()
+}
+
+// countSeries returns the number of series exposed for metrics, a histogram is exposed as
+// a series per bucket including +Inf, plus sum and count
+func countSeries(metrics []prometheus.Metric) int {
+	series := 0
+	for _, m := range metrics {
+		pb := &dto.Metric{}
+		if err := m.Write(pb); err == nil && pb.Histogram != nil {
+			series += len(pb.Histogram.Bucket) + 3
+			continue
+		}
+		series++
+	}
+	return series
+}
+
+// pruneQueryStats forgets statistics of queries not in queryInstanceMap, e.g. removed or renamed by a config reload
+func (s *Server) pruneQueryStats(queryInstanceMap map[string]*QueryInstance) {
+	s.statsMtx.Lock()
+	defer s.statsMtx.Unlock()
+	for name := range s.queryStats {
+		if _, ok := queryInstanceMap[name]; !ok {
+			delete(s.queryStats, name)
+		}
+	}
+}
+
+func (s *Server) countCacheHit(metricName string) {
+	s.statsMtx.Lock()
+	defer s.statsMtx.Unlock()
+	s.stat(metricName).cacheHits++
+}
+
+// collectQueryStats emit per query statistics of this server
+func (s *Server) collectQueryStats(ch chan<- prometheus.Metric) {
+	s.statsMtx.Lock()
+	defer s.statsMtx.Unlock()
+
+	droppedDesc := prometheus.NewDesc(prometheus.BuildFQName(s.namespace, "exporter", "query_dropped_series"),
+		"Number of series dropped by max_series on the last execution of a query.", []string{"query"}, s.labels)
+	skippedDesc := prometheus.NewDesc(prometheus.BuildFQName(s.namespace, "exporter", "query_skipped"),
+		"Whether a query was skipped because its predicate is not satisfied, 1 for skipped.", []string{"query"}, s.labels)
+	errorsDesc := prometheus.NewDesc(prometheus.BuildFQName(s.namespace, "exporter", "query_errors_total"),
+		"Number of errors of a query by class: timeout, permission, syntax, parse or other.", []string{"query", "class"}, s.labels)
+	executionsDesc := prometheus.NewDesc(prometheus.BuildFQName(s.namespace, "exporter", "query_executions_total"),
+		"Number of executions of a query on database.", []string{"query"}, s.labels)
+	cacheHitsDesc := prometheus.NewDesc(prometheus.BuildFQName(s.namespace, "exporter", "query_cache_hits_total"),
+		"Number of scrapes of a query served from cached metrics.", []string{"query"}, s.labels)
+	durationDesc := prometheus.NewDesc(prometheus.BuildFQName(s.namespace, "exporter", "query_duration_seconds"),
+		"Duration of the last execution of a query.", []string{"query"}, s.labels)
+	rowsDesc := prometheus.NewDesc(prometheus.BuildFQName(s.namespace, "exporter", "query_rows"),
+		"Number of rows returned by the last execution of a query.", []string{"query"}, s.labels)
+	seriesDesc := prometheus.NewDesc(prometheus.BuildFQName(s.namespace, "exporter", "query_series"),
+		"Number of series emitted by the last execution of a query.", []string{"query"}, s.labels)
+	lastSuccessDesc := prometheus.NewDesc(prometheus.BuildFQName(s.namespace, "exporter", "query_last_success_timestamp_seconds"),
+		"Unix time of the end of the last successful execution of a query.", []string{"query"}, s.labels)
+
+	names := make([]string, 0, len(s.queryStats))
+	for name := range s.queryStats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		stat := s.queryStats[name]
+		ch <- prometheus.MustNewConstMetric(droppedDesc, prometheus.GaugeValue, float64(stat.droppedSeries), name)
+		ch <- prometheus.MustNewConstMetric(executionsDesc, prometheus.CounterValue, float64(stat.executions), name)
+		ch <- prometheus.MustNewConstMetric(cacheHitsDesc, prometheus.CounterValue, float64(stat.cacheHits), name)
+		if stat.executions > 0 {
+			ch <- prometheus.MustNewConstMetric(durationDesc, prometheus.GaugeValue, stat.duration.Seconds(), name)
+			ch <- prometheus.MustNewConstMetric(rowsDesc, prometheus.GaugeValue, float64(stat.rows), name)
+			ch <- prometheus.MustNewConstMetric(seriesDesc, prometheus.GaugeValue, float64(stat.series), name)
+			for _, class := range errClasses {
+				ch <- prometheus.MustNewConstMetric(errorsDesc, prometheus.CounterValue, float64(stat.errors[class]), name, class)
+			}
+		}
+		if !stat.lastSuccess.IsZero() {
+			ch <- prometheus.MustNewConstMetric(lastSuccessDesc, prometheus.GaugeValue, float64(stat.lastSuccess.UnixNano())/1e9, name)
+		}
+		if !stat.predicate {
+			continue
+		}
+		skipped := 0.0
+		if stat.skipped {
+			skipped = 1
+		}
+		ch <- prometheus.MustNewConstMetric(skippedDesc, prometheus.GaugeValue, skipped, name)
+	}
+}
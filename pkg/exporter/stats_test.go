@@ -0,0 +1,167 @@
+// Copyright © 2021 Bin Liu <bin.liu@enmotech.com>
+
+package exporter
+
+import (
+	"fmt"
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func Test_classifyError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{name: "timeout", err: &ErrorQueryTimeout{Msg: "timeout"}, want: errClassTimeout},
+		{name: "permission", err: fmt.Errorf("query: %w", &pq.Error{Code: "42501"}), want: errClassPermission},
+		{name: "syntax", err: fmt.Errorf("query: %w", &pq.Error{Code: "42601"}), want: errClassSyntax},
+		{name: "undefined_table", err: &pq.Error{Code: "42P01"}, want: errClassSyntax},
+		{name: "parse", err: fmt.Errorf("pivot: %w", &ErrorParseValue{Msg: "a"}), want: errClassParse},
+		{name: "connection", err: &pq.Error{Code: "08006"}, want: errClassOther},
+		{name: "other", err: fmt.Errorf("error"), want: errClassOther},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, classifyError(tt.err))
+		})
+	}
+}
+
+func Test_Server_collectQueryStats_telemetry(t *testing.T) {
+	queryInstance := &QueryInstance{
+		Name: "pg_lock",
+		TTL:  60,
+		Queries: []*Query{
+			{SQL: "SELECT datname, count FROM pg_locks"},
+		},
+		Metrics: []*Column{
+			{Name: "datname", Usage: LABEL},
+			{Name: "count", Usage: GAUGE},
+		},
+	}
+	s, mock := newMockServer(t, queryInstance)
+	stats := func() map[string]float64 {
+		ch := make(chan prometheus.Metric, 20)
+		s.collectQueryStats(ch)
+		close(ch)
+		fqNameRegexp := regexp.MustCompile(`fqName: "pg_exporter_(\w+)"`)
+		result := make(map[string]float64)
+		for m := range ch {
+			pb := &dto.Metric{}
+			assert.NoError(t, m.Write(pb))
+			name := fqNameRegexp.FindStringSubmatch(m.Desc().String())[1]
+			for _, label := range pb.GetLabel() {
+				if label.GetName() == "class" {
+					name += "/" + label.GetValue()
+				}
+			}
+			result[name] = pb.GetGauge().GetValue() + pb.GetCounter().GetValue()
+		}
+		return result
+	}
+
+	ch := make(chan prometheus.Metric, 10)
+	expectTxQuery(mock, "SELECT").WillReturnRows(sqlmock.NewRows([]string{"datname", "count"}).
+		AddRow("postgres", 1).AddRow("omm", "a").AddRow("app", 2))
+	before := time.Now()
+	errs := s.queryMetrics(ch)
+	assert.Error(t, errs["pg_lock"]) // non-fatal parse error
+	s.queryMetrics(ch)               // served from cache
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	got := stats()
+	assert.Equal(t, 1.0, got["query_executions_total"])
+	assert.Equal(t, 1.0, got["query_cache_hits_total"])
+	assert.Equal(t, 3.0, got["query_rows"])
+	assert.Equal(t, 2.0, got["query_series"])
+	assert.Equal(t, 1.0, got["query_errors_total/parse"])
+	assert.Equal(t, 0.0, got["query_errors_total/timeout"])
+	assert.GreaterOrEqual(t, got["query_duration_seconds"], 0.0)
+	assert.GreaterOrEqual(t, got["query_last_success_timestamp_seconds"], float64(before.Unix()))
+
+	// a failed execution keeps last success
+	s.disableCache = true
+	expectTxQuery(mock, "SELECT").WillReturnError(&pq.Error{Code: "42501", Message: "permission denied for relation pg_locks"})
+	assert.Error(t, s.queryMetrics(ch)["pg_lock"])
+	assert.NoError(t, mock.ExpectationsWereMet())
+	lastSuccess := got["query_last_success_timestamp_seconds"]
+	got = stats()
+	assert.Equal(t, 2.0, got["query_executions_total"])
+	assert.Equal(t, 1.0, got["query_errors_total/permission"])
+	assert.Equal(t, 0.0, got["query_rows"])
+	assert.Equal(t, 0.0, got["query_series"])
+	assert.Equal(t, lastSuccess, got["query_last_success_timestamp_seconds"])
+}
+
+func Test_Server_observeExecution_classes(t *testing.T) {
+	queryInstance := &QueryInstance{
+		Name:       "pg_lock",
+		SortColumn: "missing",
+		Queries: []*Query{
+			{SQL: "SELECT datname, count, mode FROM pg_locks"},
+		},
+		Metrics: []*Column{
+			{Name: "datname", Usage: LABEL},
+			{Name: "count", Usage: GAUGE},
+			{Name: "mode", Usage: MappedMETRIC, Mapping: map[string]float64{"share": 1}},
+		},
+	}
+	s, mock := newMockServer(t, queryInstance)
+
+	// missing sort column is a config error, unmapped value a parse error
+	expectTxQuery(mock, "SELECT").WillReturnRows(sqlmock.NewRows([]string{"datname", "count", "mode"}).AddRow("postgres", 1, "exclusive"))
+	s.runMetric("pg_lock", queryInstance, time.Now())
+	assert.Equal(t, map[string]int{errClassOther: 1, errClassParse: 1}, s.queryStats["pg_lock"].errors)
+
+	// on_error: fail makes the query fail with a parse error
+	queryInstance.SortColumn = ""
+	queryInstance.Columns["count"].OnError = onErrorFail
+	expectTxQuery(mock, "SELECT").WillReturnRows(sqlmock.NewRows([]string{"datname", "count", "mode"}).AddRow("postgres", "a", "share"))
+	result := s.runMetric("pg_lock", queryInstance, time.Now())
+	assert.Error(t, result.err)
+	assert.Equal(t, map[string]int{errClassOther: 1, errClassParse: 2}, s.queryStats["pg_lock"].errors)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func Test_countSeries(t *testing.T) {
+	gaugeDesc := prometheus.NewDesc("pg_lock_count", "count", nil, nil)
+	histogramDesc := prometheus.NewDesc("pg_histogram", "histogram", nil, nil)
+	metrics := []prometheus.Metric{
+		prometheus.MustNewConstMetric(gaugeDesc, prometheus.GaugeValue, 1),
+		prometheus.MustNewConstHistogram(histogramDesc, 3, 4, map[float64]uint64{1: 1, 2: 2}),
+	}
+	// gauge, buckets 1, 2 and +Inf, sum and count
+	assert.Equal(t, 6, countSeries(metrics))
+}
+
+func Test_Server_pruneQueryStats(t *testing.T) {
+	queryInstance := &QueryInstance{
+		Name: "pg_lock",
+		Queries: []*Query{
+			{SQL: "SELECT datname, count FROM pg_locks"},
+		},
+		Metrics: []*Column{
+			{Name: "datname", Usage: LABEL},
+			{Name: "count", Usage: GAUGE},
+		},
+	}
+	s, mock := newMockServer(t, queryInstance)
+	expectTxQuery(mock, "SELECT").WillReturnRows(sqlmock.NewRows([]string{"datname", "count"}).AddRow("postgres", 1))
+	s.runMetric("pg_lock", queryInstance, time.Now())
+	assert.Contains(t, s.queryStats, "pg_lock")
+
+	// statistics of queries removed by config reload are no longer exported
+	s.setQueryInstanceMap(map[string]*QueryInstance{})
+	ch := make(chan prometheus.Metric, 20)
+	s.collectQueryStats(ch)
+	assert.Len(t, ch, 0)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
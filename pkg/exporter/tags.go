@@ -0,0 +1,84 @@
+// Copyright © 2020 Bin Liu <bin.liu@enmotech.com>
+
+package exporter
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Built-in profiles, from the lightest to the deepest monitoring. A query tagged
+// with a profile runs on servers with that profile or a deeper one. Queries
+// without profile tag belong to standard, servers without profile tag use full.
+const (
+	profileMinimal  = "minimal"
+	profileStandard = "standard"
+	profileFull     = "full"
+)
+
+var profileLevels = map[string]int{
+	profileMinimal:  1,
+	profileStandard: 2,
+	profileFull:     3,
+}
+
+// tagExcludePrefix marks a query tag that excludes servers having the tag
+const tagExcludePrefix = "!"
+
+// checkTags validate query tags
+func checkTags(tags []string) error {
+	for _, tag := range tags {
+		name := strings.TrimPrefix(tag, tagExcludePrefix)
+		if strings.TrimSpace(name) != name || name == "" || strings.HasPrefix(name, tagExcludePrefix) {
+			return fmt.Errorf("invalid tag %q", tag)
+		}
+		if _, isProfile := profileLevels[name]; isProfile && name != tag {
+			return fmt.Errorf("profile tag %q can not be excluded", tag)
+		}
+	}
+	return nil
+}
+
+// MatchTags reports whether a query with queryTags should run on a server with serverTags:
+//   - the server profile must be at least the query profile
+//   - every plain query tag must be one of the server tags (include)
+//   - no "!tag" query tag may be one of the server tags (exclude)
+func MatchTags(queryTags, serverTags []string) bool {
+	serverProfile := 0
+	serverTagSet := make(map[string]bool, len(serverTags))
+	for _, tag := range serverTags {
+		if level, ok := profileLevels[tag]; ok {
+			if level > serverProfile {
+				serverProfile = level
+			}
+			continue
+		}
+		serverTagSet[tag] = true
+	}
+	if serverProfile == 0 {
+		serverProfile = profileLevels[profileFull]
+	}
+
+	queryProfile := 0
+	for _, tag := range queryTags {
+		if level, ok := profileLevels[tag]; ok {
+			if queryProfile == 0 || level < queryProfile {
+				queryProfile = level
+			}
+			continue
+		}
+		if strings.HasPrefix(tag, tagExcludePrefix) {
+			if serverTagSet[strings.TrimPrefix(tag, tagExcludePrefix)] {
+				return false
+			}
+			continue
+		}
+		if !serverTagSet[tag] {
+			return false
+		}
+	}
+	if queryProfile == 0 {
+		queryProfile = profileLevels[profileStandard]
+	}
+	return queryProfile <= serverProfile
+}
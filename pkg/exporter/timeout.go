@@ -0,0 +1,120 @@
+// Copyright © 2021 Bin Liu <bin.liu@enmotech.com>
+
+package exporter
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/lib/pq"
+	"github.com/prometheus/common/log"
+	"strings"
+	"time"
+)
+
+// pq error codes of statements stopped by statement_timeout, cancellation or lock timeout
+var timeoutErrorCodes = map[pq.ErrorCode]bool{
+	"57014": true, // query_canceled
+	"55P03": true, // lock_not_available
+}
+
+// timeoutSQL returns statements limiting execution and lock wait of the current transaction.
+// lockwait_timeout is the lock_timeout of openGauss.
+func timeoutSQL(timeout time.Duration) string {
+	ms := timeout.Milliseconds()
+	if ms < 1 {
+		ms = 1
+	}
+	return fmt.Sprintf("SET LOCAL statement_timeout = %d; SET LOCAL lockwait_timeout = %d", ms, ms)
+}
+
+// isTimeout reports whether err is caused by timeout of the query, either of ctx or of database
+func isTimeout(ctx context.Context, err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) || ctx.Err() == context.DeadlineExceeded {
+		return true
+	}
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		return timeoutErrorCodes[pqErr.Code] || strings.Contains(strings.ToLower(pqErr.Message), "lock wait timeout")
+	}
+	return false
+}
+
+// errPredicateNotSatisfied is returned by queryRows when the predicate returns false or null,
+// or fails as an object it refers to does not exist
+var errPredicateNotSatisfied = errors.New("predicate not satisfied")
+
+// pq error codes of predicates referring to views or schemas missing on this instance
+var missingObjectErrorCodes = map[pq.ErrorCode]bool{
+	"42P01": true, // undefined_table
+	"3F000": true, // invalid_schema_name
+}
+
+// queryRows executes predicate if any, then query in a read only transaction and reads all rows.
+// statement_timeout and lockwait_timeout are set to query timeout, so that both are stopped by
+// database even if cancellation by ctx does not reach it, e.g. while waiting on a lock.
+func (s *Server) queryRows(ctx context.Context, metricName, predicate string, query *Query) ([]string, [][]interface{}, error) {
+	tx, err := s.db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return nil, nil, s.queryError(ctx, metricName, query, err)
+	}
+	defer tx.Rollback() // nolint: errcheck // read only, nothing to commit
+
+	if query.Timeout > 0 {
+		if _, err = tx.ExecContext(ctx, timeoutSQL(query.TimeoutDuration())); err != nil {
+			return nil, nil, s.queryError(ctx, metricName, query, err)
+		}
+	}
+	if predicate != "" {
+		var ok sql.NullBool
+		if err = tx.QueryRowContext(ctx, predicate).Scan(&ok); err != nil {
+			var pqErr *pq.Error
+			if errors.As(err, &pqErr) && missingObjectErrorCodes[pqErr.Code] {
+				log.Debugf("queryMetric [%s] predicate not satisfied: %s", metricName, err)
+				return nil, nil, errPredicateNotSatisfied
+			}
+			return nil, nil, s.queryError(ctx, metricName, query, fmt.Errorf("predicate: %w", err))
+		}
+		if !ok.Valid || !ok.Bool {
+			return nil, nil, errPredicateNotSatisfied
+		}
+	}
+	rows, err := tx.QueryContext(ctx, query.SQL, query.Args()...)
+	if err != nil {
+		return nil, nil, s.queryError(ctx, metricName, query, err)
+	}
+	defer rows.Close() // nolint: errcheck
+
+	columnNames, err := rows.Columns()
+	if err != nil {
+		return nil, nil, errors.New(fmt.Sprintln("Error retrieving column list for: ", metricName, err))
+	}
+	var rowsData [][]interface{}
+	for rows.Next() {
+		var columnData = make([]interface{}, len(columnNames))
+		var scanArgs = make([]interface{}, len(columnNames))
+		for i := range columnData {
+			scanArgs[i] = &columnData[i]
+		}
+		if err = rows.Scan(scanArgs...); err != nil {
+			return nil, nil, errors.New(fmt.Sprintln("Error retrieving rows:", metricName, err))
+		}
+		rowsData = append(rowsData, columnData)
+	}
+	if err = rows.Err(); err != nil {
+		log.Debugf("queryMetric [%s] rows error %s", metricName, err)
+		return nil, nil, s.queryError(ctx, metricName, query, err)
+	}
+	return columnNames, rowsData, nil
+}
+
+// queryError logs and wraps error of executing query, timeout is returned as *ErrorQueryTimeout
+func (s *Server) queryError(ctx context.Context, metricName string, query *Query, err error) error {
+	if isTimeout(ctx, err) {
+		log.Errorf("queryMetric [%s] executing timeout %vs: %s", metricName, query.Timeout, err)
+		return &ErrorQueryTimeout{fmt.Sprintf("Timeout running queryMetric on database %q query: %s after %vs: %v ", s, metricName, query.Timeout, err)}
+	}
+	log.Errorf("queryMetric [%s] executing err %s", metricName, err)
+	return fmt.Errorf("Error running queryMetric on database %q query: %s %w ", s, metricName, err)
+}
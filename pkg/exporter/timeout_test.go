@@ -0,0 +1,74 @@
+// Copyright © 2021 Bin Liu <bin.liu@enmotech.com>
+
+package exporter
+
+import (
+	"context"
+	"fmt"
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func Test_timeoutSQL(t *testing.T) {
+	assert.Equal(t, "SET LOCAL statement_timeout = 100; SET LOCAL lockwait_timeout = 100", timeoutSQL(100*time.Millisecond))
+	assert.Equal(t, "SET LOCAL statement_timeout = 1; SET LOCAL lockwait_timeout = 1", timeoutSQL(time.Microsecond))
+}
+
+func Test_isTimeout(t *testing.T) {
+	ctx := context.Background()
+	expired, cancel := context.WithTimeout(ctx, 0)
+	defer cancel()
+	tests := []struct {
+		name string
+		ctx  context.Context
+		err  error
+		want bool
+	}{
+		{name: "deadline", ctx: ctx, err: fmt.Errorf("query: %w", context.DeadlineExceeded), want: true},
+		{name: "expired", ctx: expired, err: fmt.Errorf("driver: bad connection"), want: true},
+		{name: "statement_timeout", ctx: ctx, err: &pq.Error{Code: "57014", Message: "canceling statement due to statement timeout"}, want: true},
+		{name: "lock_not_available", ctx: ctx, err: &pq.Error{Code: "55P03", Message: "could not obtain lock"}, want: true},
+		{name: "lockwait_timeout", ctx: ctx, err: &pq.Error{Code: "YY003", Message: "Lock wait timeout: thread 1 on node dn waiting for ShareLock"}, want: true},
+		{name: "permission", ctx: ctx, err: &pq.Error{Code: "42501", Message: "permission denied for relation statement"}, want: false},
+		{name: "other", ctx: ctx, err: fmt.Errorf("error"), want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, isTimeout(tt.ctx, tt.err))
+		})
+	}
+}
+
+func Test_Server_queryMetrics_timeout(t *testing.T) {
+	queryInstance := &QueryInstance{
+		Name:    "pg_lock",
+		Timeout: 0.5,
+		Queries: []*Query{
+			{SQL: "SELECT datname, count FROM pg_locks"},
+		},
+		Metrics: []*Column{
+			{Name: "datname", Usage: LABEL},
+			{Name: "count", Usage: GAUGE},
+		},
+	}
+	s, mock := newMockServer(t, queryInstance)
+	s.disableCache = true
+
+	mock.ExpectBegin()
+	mock.ExpectExec("SET LOCAL statement_timeout = 500; SET LOCAL lockwait_timeout = 500").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("SELECT").WillReturnError(&pq.Error{Code: "57014", Message: "canceling statement due to statement timeout"})
+	mock.ExpectRollback()
+	expectTxQuery(mock, "SELECT").WillReturnError(fmt.Errorf("relation does not exist"))
+	ch := make(chan prometheus.Metric, 10)
+	errs := s.queryMetrics(ch)
+	assert.IsType(t, &ErrorQueryTimeout{}, errs["pg_lock"])
+	errs = s.queryMetrics(ch)
+	assert.Error(t, errs["pg_lock"])
+	assert.Equal(t, errClassOther, classifyError(errs["pg_lock"]))
+	assert.NoError(t, mock.ExpectationsWereMet())
+	assert.Equal(t, map[string]int{errClassTimeout: 1, errClassOther: 1}, s.queryStats["pg_lock"].errors)
+}
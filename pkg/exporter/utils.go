@@ -11,6 +11,7 @@ import (
 	"net/url"
 	"regexp"
 	"strings"
+	"sync"
 )
 
 // ShadowDSN will hide password part of dsn
@@ -84,6 +85,25 @@ func parseCSV(s string) (tags []string) {
 	return
 }
 
+// sanitizeMetricName turn an arbitrary string into a lower case metric name fragment,
+// replacing invalid characters with underscore, e.g. "CPU time" -> "cpu_time"
+func sanitizeMetricName(s string) string {
+	var b strings.Builder
+	underscore := false
+	for _, r := range strings.ToLower(strings.TrimSpace(s)) {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			b.WriteRune(r)
+			underscore = false
+			continue
+		}
+		if !underscore && b.Len() > 0 {
+			b.WriteByte('_')
+			underscore = true
+		}
+	}
+	return strings.TrimRight(b.String(), "_")
+}
+
 func parseVersionSem(versionString string) (semver.Version, error) {
 	version := parseVersion(versionString)
 	if version != "" {
@@ -102,3 +122,28 @@ func parseVersion(versionString string) string {
 	}
 	return ""
 }
+
+// forEachLimit calls fn for every index in [0, n), with at most limit calls running at the same time.
+// Calls are made in order on the calling goroutine when limit is 1 or less.
+func forEachLimit(n, limit int, fn func(i int)) {
+	if limit <= 1 {
+		for i := 0; i < n; i++ {
+			fn(i)
+		}
+		return
+	}
+	sem := make(chan struct{}, limit)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(i int) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			fn(i)
+		}(i)
+	}
+	wg.Wait()
+}
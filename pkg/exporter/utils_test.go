@@ -7,7 +7,9 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/stretchr/testify/assert"
 	"reflect"
+	"sync"
 	"testing"
+	"time"
 )
 
 func Test_parseConstLabels(t *testing.T) {
@@ -284,3 +286,61 @@ func Test_parseVersion(t *testing.T) {
 		})
 	}
 }
+
+func Test_sanitizeMetricName(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{name: "DB_TIME", want: "db_time"},
+		{name: "CPU time", want: "cpu_time"},
+		{name: " max_dynamic_memory ", want: "max_dynamic_memory"},
+		{name: "Wait (us)", want: "wait_us"},
+		{name: "__x--y__", want: "x_y"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, sanitizeMetricName(tt.name))
+		})
+	}
+}
+
+func Test_forEachLimit(t *testing.T) {
+	const n = 7
+	tests := []struct {
+		name  string
+		limit int
+		want  int
+	}{
+		{name: "unset", limit: 0, want: 1},
+		{name: "serial", limit: 1, want: 1},
+		{name: "parallel", limit: 3, want: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var (
+				m            sync.Mutex
+				running, max int
+				visited      = make(map[int]int)
+			)
+			forEachLimit(n, tt.limit, func(i int) {
+				m.Lock()
+				running++
+				if running > max {
+					max = running
+				}
+				visited[i]++
+				m.Unlock()
+				time.Sleep(10 * time.Millisecond)
+				m.Lock()
+				running--
+				m.Unlock()
+			})
+			assert.Equal(t, tt.want, max)
+			assert.Len(t, visited, n)
+			for i := 0; i < n; i++ {
+				assert.Equal(t, 1, visited[i])
+			}
+		})
+	}
+}